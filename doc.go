@@ -2,9 +2,9 @@
 
 Package webx provides a client for the webx protocol.
 Webx is a reverse HTTP proxy protocol. Upstream HTTP
-servers connect to a Webx router as RSPDY clients, while
+servers connect to a Webx router as RSPDY or rh2 clients, while
 HTTP clients connect to the Webx router as regular
-HTTP (or SPDY) clients.
+HTTP/1.1 or HTTP/2 clients.
 
 This package's interface is experimental and subject to change.
 
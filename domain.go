@@ -0,0 +1,51 @@
+package webx
+
+import (
+	"os"
+	"strings"
+)
+
+// Domain names used by the router, the API, and clients.
+// They default to the public webx service. A private
+// deployment can set WEBX_DOMAIN and WEBX_APP_DOMAIN in
+// the environment of every program to change them all.
+var (
+	Domain    = getenv("WEBX_DOMAIN", "webx.io")
+	AppDomain = getenv("WEBX_APP_DOMAIN", "webxapp.io") // app foo is foo.AppDomain
+
+	RouteHost = "route." + Domain // where backends connect
+	APIHost   = "api." + Domain   // API requests, on the router and uapi
+)
+
+// BackendHost is the host of requests from the router to a
+// backend, such as the names handshake and health checks.
+// A deployment can set it with WEBX_BACKEND_HOST. It doesn't
+// follow WEBX_DOMAIN, so a router and a dyno that disagree
+// about the domain still agree on this.
+var BackendHost = getenv("WEBX_BACKEND_HOST", "backend.webx.io")
+
+// ReservedHost reports whether host belongs to the service,
+// so no app can claim it as a custom domain: AppDomain,
+// Domain, any name under them, or one of the router's own
+// hosts. Otherwise an app could take another app's name,
+// or the router's, and get its traffic.
+func ReservedHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, d := range []string{AppDomain, Domain} {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	switch host {
+	case RouteHost, APIHost, BackendHost:
+		return true
+	}
+	return false
+}
+
+func getenv(key, def string) string {
+	if s := os.Getenv(key); s != "" {
+		return s
+	}
+	return def
+}
@@ -0,0 +1,68 @@
+// Package logline formats structured log lines, as
+// written by urouter's access log and by webxd.
+//
+// A line is a list of fields, each a key and a value.
+// Values may be strings, ints, int64s, bools, or float64s;
+// floats are written with three decimal places.
+package logline
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// JSON returns f as a JSON object, with keys in order.
+func JSON(f [][2]interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, kv := range f {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(kv[0])
+		v, _ := json.Marshal(kv[1])
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// Logfmt returns f as space-separated key=value pairs.
+// Values that are empty or contain spaces, quotes, equals
+// signs, backslashes, or control characters are quoted.
+func Logfmt(f [][2]interface{}) []byte {
+	var buf bytes.Buffer
+	for i, kv := range f {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(kv[0].(string))
+		buf.WriteByte('=')
+		var s string
+		switch v := kv[1].(type) {
+		case string:
+			s = v
+		case int:
+			s = strconv.Itoa(v)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		case bool:
+			s = strconv.FormatBool(v)
+		case float64:
+			s = strconv.FormatFloat(v, 'f', 3, 64)
+		}
+		if s == "" || strings.ContainsAny(s, " \"=\\") || strings.IndexFunc(s, isControl) >= 0 {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+	return buf.Bytes()
+}
+
+func isControl(r rune) bool {
+	return r < ' ' || r == 0x7f
+}
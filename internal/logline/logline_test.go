@@ -0,0 +1,29 @@
+package logline
+
+import (
+	"testing"
+)
+
+var testFields = [][2]interface{}{
+	{"path", "/a b"},
+	{"id", ""},
+	{"status", 200},
+	{"bytes", int64(5)},
+	{"upgraded", false},
+	{"ms", 1.5},
+	{"err", "bad\nline"},
+}
+
+func TestLogfmt(t *testing.T) {
+	const want = `path="/a b" id="" status=200 bytes=5 upgraded=false ms=1.500 err="bad\nline"`
+	if g := string(Logfmt(testFields)); g != want {
+		t.Errorf("Logfmt = %s\nwant    %s", g, want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	const want = `{"path":"/a b","id":"","status":200,"bytes":5,"upgraded":false,"ms":1.5,"err":"bad\nline"}`
+	if g := string(JSON(testFields)); g != want {
+		t.Errorf("JSON = %s\nwant    %s", g, want)
+	}
+}
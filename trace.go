@@ -0,0 +1,415 @@
+package webx
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A TraceContext identifies a span, as carried in the
+// W3C traceparent and tracestate header fields.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+	State   string // tracestate, passed along unchanged
+}
+
+// ParseTraceparent parses a traceparent header field value,
+// e.g. "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+// It reports whether s was valid.
+func ParseTraceparent(s string) (tc TraceContext, ok bool) {
+	f := strings.Split(strings.TrimSpace(s), "-")
+	if len(f) < 4 || len(f[0]) != 2 || f[0] == "ff" {
+		return tc, false
+	}
+	if f[0] == "00" && len(f) != 4 {
+		return tc, false
+	}
+	if len(f[1]) != 32 || len(f[2]) != 16 || len(f[3]) != 2 {
+		return tc, false
+	}
+	for _, x := range f[:4] {
+		if !isLowerHex(x) {
+			return tc, false
+		}
+	}
+	if _, err := hex.Decode(tc.TraceID[:], []byte(f[1])); err != nil {
+		return tc, false
+	}
+	if _, err := hex.Decode(tc.SpanID[:], []byte(f[2])); err != nil {
+		return tc, false
+	}
+	flags, err := strconv.ParseUint(f[3], 16, 8)
+	if err != nil {
+		return tc, false
+	}
+	if tc.TraceID == [16]byte{} || tc.SpanID == [8]byte{} {
+		return tc, false
+	}
+	tc.Sampled = flags&1 != 0
+	return tc, true
+}
+
+// isLowerHex reports whether s is all lowercase hex digits,
+// as traceparent requires.
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Traceparent formats tc as a traceparent header field value.
+func (tc TraceContext) Traceparent() string {
+	flags := "00"
+	if tc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(tc.TraceID[:]) + "-" + hex.EncodeToString(tc.SpanID[:]) + "-" + flags
+}
+
+// A Tracer makes spans for HTTP requests and exports
+// them to an OpenTelemetry collector using OTLP over
+// HTTP, with the JSON encoding.
+//
+// A nil *Tracer still propagates trace context
+// but exports nothing.
+type Tracer struct {
+	// URL is the collector's traces endpoint,
+	// e.g. http://localhost:4318/v1/traces.
+	URL string
+
+	// Service is the service.name resource attribute,
+	// e.g. "urouter".
+	Service string
+
+	// Client sends spans to URL.
+	// If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Interval is how often to export spans.
+	// If zero, DefaultTraceInterval is used.
+	Interval time.Duration
+
+	// Timeout bounds each export, and how long Close waits.
+	// If zero, DefaultTraceTimeout is used.
+	Timeout time.Duration
+
+	// ErrorLog logs export errors.
+	// If nil, errors are not logged.
+	ErrorLog *log.Logger
+
+	once   sync.Once // starts exportLoop
+	stop   chan bool // closed by Close
+	done   chan bool // closed when exportLoop returns
+	mu     sync.Mutex
+	spans  []*Span
+	closed bool
+}
+
+const (
+	DefaultTraceInterval = 5 * time.Second
+	DefaultTraceTimeout  = 10 * time.Second
+	maxQueuedSpans       = 4096 // more than this are dropped
+)
+
+// Span kinds, as in OTLP.
+const (
+	SpanServer = 2
+	SpanClient = 3
+)
+
+// A Span records one operation in a trace.
+type Span struct {
+	TraceContext
+	Parent [8]byte // zero for a root span
+	Name   string
+	Kind   int
+	Start  time.Time
+	End    time.Time
+	Attrs  map[string]interface{} // string, int, int64, or bool values
+	Err    string                 // status message, if the operation failed
+
+	tracer *Tracer
+}
+
+// StartRequest starts a server span for r, continuing
+// the trace in r's traceparent header field, if any,
+// or else starting a new one. It replaces traceparent
+// in r.Header with the new span, so when r is forwarded,
+// the next hop continues the trace as its child.
+//
+// If t is nil, StartRequest leaves r alone and returns nil.
+// All Span methods do nothing on a nil span.
+func (t *Tracer) StartRequest(r *http.Request, name string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		Name:   name,
+		Kind:   SpanServer,
+		Start:  time.Now(),
+		tracer: t,
+	}
+	if tc, ok := ParseTraceparent(r.Header.Get("Traceparent")); ok {
+		s.TraceContext = tc
+		s.Parent = tc.SpanID
+		s.State = r.Header.Get("Tracestate")
+	} else {
+		// tracestate belongs to the trace in traceparent;
+		// it means nothing in a new one.
+		r.Header.Del("Tracestate")
+		randBytes(s.TraceID[:])
+		s.Sampled = true
+	}
+	randBytes(s.SpanID[:])
+	r.Header.Set("Traceparent", s.Traceparent())
+	s.SetAttr("http.method", r.Method)
+	s.SetAttr("http.host", r.Host)
+	s.SetAttr("http.target", r.URL.RequestURI())
+	return s
+}
+
+// TraceIDString returns the span's trace ID in hex,
+// or the empty string if s is nil.
+func (s *Span) TraceIDString() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.TraceID[:])
+}
+
+// SetAttr sets attribute k of s to v.
+func (s *Span) SetAttr(k string, v interface{}) {
+	if s == nil {
+		return
+	}
+	if s.Attrs == nil {
+		s.Attrs = make(map[string]interface{})
+	}
+	s.Attrs[k] = v
+}
+
+// SetStatus records the HTTP status code of s.
+// Codes of 500 and up mark the span as failed.
+func (s *Span) SetStatus(code int) {
+	if s == nil {
+		return
+	}
+	s.SetAttr("http.status_code", code)
+	if code >= 500 && s.Err == "" {
+		s.Err = http.StatusText(code)
+	}
+}
+
+// SetError marks s as failed, with message msg.
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.Err = msg
+}
+
+// Finish ends s and queues it for export, if sampled.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	if s.Sampled {
+		s.tracer.queue(s)
+	}
+}
+
+func (t *Tracer) queue(s *Span) {
+	t.once.Do(t.start)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed && len(t.spans) < maxQueuedSpans {
+		t.spans = append(t.spans, s)
+	}
+}
+
+func (t *Tracer) start() {
+	t.stop = make(chan bool)
+	t.done = make(chan bool)
+	go t.exportLoop()
+}
+
+func (t *Tracer) exportLoop() {
+	defer close(t.done)
+	d := t.Interval
+	if d <= 0 {
+		d = DefaultTraceInterval
+	}
+	tick := time.NewTicker(d)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-t.stop:
+			return
+		}
+		if err := t.Flush(); err != nil && t.ErrorLog != nil {
+			t.ErrorLog.Println("webx: export spans:", err)
+		}
+	}
+}
+
+// Close stops exporting spans in the background and
+// exports the ones still queued, waiting at most Timeout.
+// Spans that finish after Close are dropped. Close on
+// a nil *Tracer does nothing.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	closed := t.closed
+	t.closed = true
+	t.mu.Unlock()
+	if closed {
+		return nil
+	}
+	t.once.Do(func() {}) // too late to start exportLoop
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout())
+	defer cancel()
+	if t.stop != nil {
+		close(t.stop)
+		select {
+		case <-t.done:
+		case <-ctx.Done(): // an export in progress is stuck
+			return ctx.Err()
+		}
+	}
+	return t.flush(ctx)
+}
+
+// Flush exports all queued spans now, waiting at most
+// Timeout. Spans that fail to export are dropped.
+func (t *Tracer) Flush() error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout())
+	defer cancel()
+	return t.flush(ctx)
+}
+
+func (t *Tracer) timeout() time.Duration {
+	if t.Timeout <= 0 {
+		return DefaultTraceTimeout
+	}
+	return t.Timeout
+}
+
+func (t *Tracer) flush(ctx context.Context) error {
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(otlpRequest(t.Service, spans))
+	if err != nil {
+		return err
+	}
+	c := t.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	req, err := http.NewRequest("POST", t.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("collector returned " + resp.Status)
+	}
+	return nil
+}
+
+// otlpRequest returns an OTLP ExportTraceServiceRequest
+// for spans, ready to encode as JSON.
+func otlpRequest(service string, spans []*Span) interface{} {
+	type J = map[string]interface{}
+	var a []J
+	for _, s := range spans {
+		j := J{
+			"traceId":           hex.EncodeToString(s.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.SpanID[:]),
+			"name":              s.Name,
+			"kind":              s.Kind,
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        otlpAttrs(s.Attrs),
+		}
+		if s.Parent != [8]byte{} {
+			j["parentSpanId"] = hex.EncodeToString(s.Parent[:])
+		}
+		if s.State != "" {
+			j["traceState"] = s.State
+		}
+		if s.Err != "" {
+			j["status"] = J{"code": 2, "message": s.Err}
+		}
+		a = append(a, j)
+	}
+	return J{"resourceSpans": []J{{
+		"resource": J{"attributes": otlpAttrs(map[string]interface{}{
+			"service.name": service,
+		})},
+		"scopeSpans": []J{{
+			"scope": J{"name": "github.com/kr/webx"},
+			"spans": a,
+		}},
+	}}}
+}
+
+func otlpAttrs(m map[string]interface{}) []map[string]interface{} {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	a := []map[string]interface{}{}
+	for _, k := range keys {
+		var val map[string]interface{}
+		switch v := m[k].(type) {
+		case string:
+			val = map[string]interface{}{"stringValue": v}
+		case int:
+			val = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			val = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			val = map[string]interface{}{"boolValue": v}
+		default:
+			continue
+		}
+		a = append(a, map[string]interface{}{"key": k, "value": val})
+	}
+	return a
+}
+
+func randBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,180 @@
+package webx
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const s = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tc, ok := ParseTraceparent(s)
+	if !ok {
+		t.Fatal("ParseTraceparent failed")
+	}
+	if got := tc.Traceparent(); got != s {
+		t.Errorf("Traceparent() = %q want %q", got, s)
+	}
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00F067AA0BA902B7-01",
+		"0a-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0A",
+	} {
+		if _, ok := ParseTraceparent(bad); ok {
+			t.Errorf("ParseTraceparent(%q) ok, want failure", bad)
+		}
+	}
+}
+
+func TestTracerExport(t *testing.T) {
+	got := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got <- b
+	}))
+	defer collector.Close()
+
+	tr := &Tracer{URL: collector.URL + "/v1/traces", Service: "test"}
+	r, _ := http.NewRequest("GET", "http://foo.webxapp.io/", nil)
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r.Header.Set("Traceparent", parent)
+	s := tr.StartRequest(r, "request")
+	s.SetStatus(502)
+	s.Finish()
+
+	tc, ok := ParseTraceparent(r.Header.Get("Traceparent"))
+	if !ok || tc.TraceID != s.TraceID || tc.SpanID != s.SpanID {
+		t.Errorf("forwarded traceparent = %q, want child of %q", r.Header.Get("Traceparent"), parent)
+	}
+	if err := tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Status       struct{ Code int }
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(<-got, &req); err != nil {
+		t.Fatal(err)
+	}
+	span := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("span = %+v", span)
+	}
+	if span.Status.Code != 2 {
+		t.Errorf("status code = %d want 2", span.Status.Code)
+	}
+}
+
+func TestTracerClose(t *testing.T) {
+	got := make(chan []byte, 2)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got <- b
+	}))
+	defer collector.Close()
+
+	tr := &Tracer{URL: collector.URL + "/v1/traces", Interval: time.Hour}
+	r, _ := http.NewRequest("GET", "http://foo.webxapp.io/", nil)
+	tr.StartRequest(r, "request").Finish()
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-got:
+	default:
+		t.Fatal("Close didn't export the queued span")
+	}
+	tr.StartRequest(r, "late").Finish()
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Error("exported a span finished after Close")
+	}
+	var nilTracer *Tracer
+	if err := nilTracer.Close(); err != nil {
+		t.Errorf("nil Close = %v", err)
+	}
+}
+
+func TestTracerTimeout(t *testing.T) {
+	hang := make(chan bool)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer collector.Close()
+	defer close(hang) // before the collector closes
+
+	tr := &Tracer{
+		URL:      collector.URL + "/v1/traces",
+		Interval: time.Millisecond,
+		Timeout:  50 * time.Millisecond,
+	}
+	r, _ := http.NewRequest("GET", "http://foo.webxapp.io/", nil)
+	tr.StartRequest(r, "request").Finish()
+	time.Sleep(10 * time.Millisecond) // the loop is now stuck exporting
+	tr.StartRequest(r, "request").Finish()
+	start := time.Now()
+	if err := tr.Close(); err == nil {
+		t.Error("Close = nil want a timeout")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Close took %v", d)
+	}
+	tr = &Tracer{URL: collector.URL + "/v1/traces", Timeout: 50 * time.Millisecond}
+	tr.StartRequest(r, "request").Finish()
+	start = time.Now()
+	if err := tr.Flush(); err == nil {
+		t.Error("Flush = nil want a timeout")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Flush took %v", d)
+	}
+	tr.Close()
+}
+
+func TestNewTraceState(t *testing.T) {
+	tr := new(Tracer)
+	r, _ := http.NewRequest("GET", "http://foo.webxapp.io/", nil)
+	r.Header.Set("Traceparent", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01")
+	r.Header.Set("Tracestate", "vendor=x")
+	s := tr.StartRequest(r, "request")
+	if s.Parent != [8]byte{} {
+		t.Error("continued a trace from an invalid traceparent")
+	}
+	if g := r.Header.Get("Tracestate"); g != "" {
+		t.Errorf("tracestate = %q in a new trace, want none", g)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tr *Tracer
+	r, _ := http.NewRequest("GET", "http://foo.webxapp.io/", nil)
+	s := tr.StartRequest(r, "request")
+	s.SetAttr("k", "v")
+	s.SetStatus(502)
+	s.SetError("bad gateway")
+	s.Finish()
+	if r.Header.Get("Traceparent") != "" {
+		t.Error("nil tracer set traceparent")
+	}
+}
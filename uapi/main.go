@@ -2,21 +2,27 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"github.com/fernet/fernet-go"
 	"github.com/gorilla/mux"
+	"github.com/kr/webx"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 )
 
-const (
+var (
 	ProvisionMessage = `
 
 Getting started with Webx
@@ -25,7 +31,7 @@ Getting started with Webx
 
 	$ heroku addons:add webx --name myname
 
-This creates myname.webxapp.io pointing to your app.
+This creates myname.` + webx.AppDomain + ` pointing to your app.
 
 2. Drop this profile script in .profile.d/webx.sh,
 
@@ -34,7 +40,7 @@ This creates myname.webxapp.io pointing to your app.
 and deploy your app.
 
 Now you should be able to access your app on your shiny new
-webxapp.io domain name.
+` + webx.AppDomain + ` domain name.
 
 Enjoy!
 
@@ -47,18 +53,30 @@ Missing flag --name.
 const username = "webx"
 
 var (
-	fernetKey *fernet.Key
-	password  string
+	fernetKey  *fernet.Key
+	password   string
+	routerURL  string   // ROUTER_URL, default https://RouteHost/
+	logplexURL *url.URL // LOGPLEX_URL
 )
 
+const defLogplexURL = "https://east.logplex.io/logs"
+
 func main() {
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 	password = mustGetenv("HEROKU_PASSWORD")
-
+	routerURL = os.Getenv("ROUTER_URL")
+	if routerURL == "" {
+		routerURL = "https://" + webx.RouteHost + "/"
+	}
 	var err error
+	logplexURL, err = parseLogplexURL(os.Getenv("LOGPLEX_URL"))
+	if err != nil {
+		log.Fatal("LOGPLEX_URL: ", err)
+	}
+
 	fernetKey, err = fernet.DecodeKey(mustGetenv("FERNET_KEY"))
 	if err != nil {
 		log.Fatal(err)
@@ -103,6 +121,14 @@ type provisionopts struct {
 	Name string `json:"name"`
 }
 
+type updatereq struct {
+	Options updateopts `json:"options"`
+}
+
+type updateopts struct {
+	Domains []string `json:"domains"` // nil means leave domains alone
+}
+
 func Create(w http.ResponseWriter, r *http.Request) {
 	if !authenticate(r) {
 		log.Println("auth failure")
@@ -129,14 +155,22 @@ func Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Println("provision", hreq.Options.Name)
+	if hreq.LogplexToken != "" {
+		err = setDrain(hreq.Options.Name, drainURL(logplexURL, hreq.LogplexToken))
+		if err != nil {
+			// The app works without its router logs,
+			// so don't fail the provision over it.
+			log.Println("error setting drain:", err)
+		}
+	}
 	var out struct {
 		ID      string                    `json:"id"`
 		Config  struct{ WEBX_URL string } `json:"config"`
 		Message string                    `json:"message"`
 	}
-	out.ID = rands(10)
-	out.Config.WEBX_URL = "https://" + hreq.Options.Name + ":" + string(sig) + "@route.webx.io/"
-	out.Message = hreq.Options.Name + ".webxapp.io\n" + ProvisionMessage
+	out.ID = resourceID(hreq.Options.Name)
+	out.Config.WEBX_URL = "https://" + hreq.Options.Name + ":" + string(sig) + "@" + webx.RouteHost + "/"
+	out.Message = hreq.Options.Name + "." + webx.AppDomain + "\n" + ProvisionMessage
 	w.WriteHeader(201)
 	err = json.NewEncoder(w).Encode(out)
 	if err != nil {
@@ -161,7 +195,7 @@ func CreateRendezvous(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.WriteHeader(201)
-	url := "https://" + name + ":" + string(sig) + "@route.webx.io/"
+	url := "https://" + name + ":" + string(sig) + "@" + webx.RouteHost + "/"
 	io.WriteString(w, url)
 }
 
@@ -172,11 +206,109 @@ func Put(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var ureq updatereq
+	err := json.NewDecoder(r.Body).Decode(&ureq)
+	if err != nil && err != io.EOF {
+		log.Println("heroku sent invalid json:", err)
+		http.Error(w, "invalid json", 400)
+		return
+	}
+
 	id := mux.Vars(r)["id"]
 	log.Println("update", id)
+	if ureq.Options.Domains != nil {
+		// The name comes from the id, which we made,
+		// never from the request body.
+		name, ok := resourceName(id)
+		if !ok {
+			log.Println("update: no app name in id", id)
+			jsonError(w, "this addon is too old for custom domains; please reprovision it", 422)
+			return
+		}
+		for _, d := range ureq.Options.Domains {
+			if !domainOk(d) {
+				jsonError(w, "invalid domain: "+d, 422)
+				return
+			}
+		}
+		err = setDomains(name, ureq.Options.Domains)
+		if err != nil {
+			log.Println("error setting domains:", err)
+			jsonError(w, err.Error(), 422)
+			return
+		}
+		log.Println("domains", name, ureq.Options.Domains)
+	}
 	w.WriteHeader(200)
 }
 
+// setDomains tells the router to send requests for
+// domains to app name, replacing its previous domains.
+func setDomains(name string, domains []string) error {
+	return putRouter("domains", name, domains)
+}
+
+// setDrain tells the router to send logs for app name
+// to the drain at rawurl, or, if rawurl is empty, nowhere.
+func setDrain(name, rawurl string) error {
+	return putRouter("drain", name, rawurl)
+}
+
+// parseLogplexURL parses the logplex endpoint in s,
+// or defLogplexURL if s is empty.
+func parseLogplexURL(s string) (*url.URL, error) {
+	if s == "" {
+		s = defLogplexURL
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return nil, errors.New("want an http or https URL, got " + strconv.Quote(s))
+	}
+	return u, nil
+}
+
+// drainURL returns the drain URL for token at logplex
+// endpoint base. Logplex takes the token as the password
+// and, in each message, as the syslog app name.
+func drainURL(base *url.URL, token string) string {
+	u := *base
+	u.User = url.UserPassword("token", token)
+	return u.String()
+}
+
+// putRouter sends v as JSON to the router's API
+// at path, on behalf of app name. The token it uses
+// signs path + ":" + name, so it's good only for path.
+func putRouter(path, name string, v interface{}) error {
+	sig, err := fernet.EncryptAndSign([]byte(path+":"+name), fernetKey)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", routerURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Host = webx.APIHost
+	req.SetBasicAuth(name, string(sig))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1000))
+		return errors.New(strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
 func Delete(w http.ResponseWriter, r *http.Request) {
 	if !authenticate(r) {
 		log.Println("auth failure")
@@ -186,9 +318,48 @@ func Delete(w http.ResponseWriter, r *http.Request) {
 
 	id := mux.Vars(r)["id"]
 	log.Println("deprovision", id)
+	name, ok := resourceName(id)
+	if !ok {
+		// Provisioned before ids carried the app name.
+		log.Println("deprovision: no app name in id", id)
+		w.WriteHeader(200)
+		return
+	}
+	if err := deprovision(name); err != nil {
+		log.Println("error deprovisioning", name+":", err)
+		http.Error(w, "internal error", 500)
+		return
+	}
 	w.WriteHeader(200)
 }
 
+// deprovision tells the router to forget app name's
+// custom domains, so other apps can claim them, and
+// its log drain.
+func deprovision(name string) error {
+	if err := setDomains(name, []string{}); err != nil {
+		return err
+	}
+	return setDrain(name, "")
+}
+
+// resourceID returns a new addon resource id for app name.
+// Heroku gives it back to us on update and deprovision,
+// so the id carries the name, and we keep no table.
+func resourceID(name string) string {
+	return name + "." + rands(10)
+}
+
+// resourceName returns the app name in resource id.
+// App names can't contain ".", so it's unambiguous.
+func resourceName(id string) (name string, ok bool) {
+	i := strings.LastIndex(id, ".")
+	if i < 0 || !nameOk(id[:i]) {
+		return "", false
+	}
+	return id[:i], true
+}
+
 func Home(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "webx\n")
 }
@@ -218,7 +389,7 @@ func authenticate(r *http.Request) bool {
 		return false
 	}
 	userpass := strings.SplitN(string(dec), ":", 2)
-	return len(userpass) == 2 && userpass[0] == username || userpass[1] == password
+	return len(userpass) == 2 && userpass[0] == username && userpass[1] == password
 }
 
 func mustGetenv(key string) string {
@@ -244,6 +415,24 @@ func nameOk(s string) bool {
 	return true
 }
 
+// domainOk reports whether s looks like a host name
+// we can route, e.g. "www.example.com", and isn't one
+// of ours; see webx.ReservedHost.
+func domainOk(s string) bool {
+	if len(s) < 1 || len(s) > 253 || !strings.Contains(s, ".") {
+		return false
+	}
+	if webx.ReservedHost(s) {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if !nameOk(strings.ToLower(label)) || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
 func rands(n int) string {
 	b := make([]byte, n)
 	c, err := io.ReadFull(rand.Reader, b)
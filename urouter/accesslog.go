@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"github.com/kr/webx/internal/logline"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const defAccessLogFormat = "json" // ACCESSLOG: json, logfmt, or off
+
+var (
+	accessLogFormat           = defAccessLogFormat
+	accessLogOut    io.Writer = os.Stdout
+	accessLogMu     sync.Mutex
+)
+
+type logEntryKey struct{}
+
+// A logEntry is one line of the access log.
+// Handlers fill in what they know as the request
+// passes through them.
+type logEntry struct {
+	Time     time.Time
+	ID       string
+	TraceID  string // set by traceHandler
+	Client   string // remote address, after any PROXY header
+	Method   string
+	Host     string
+	Path     string
+	App      string        // set by Group
+	Backend  string        // set by Backend
+	Tries    int           // number of backends tried
+	Status   int           // 101 for a websocket; 0 if it failed before a response
+	Err      string        // why the router failed the request
+	Bytes    int64         // response body bytes
+	Upgraded bool          // hijacked for a websocket
+	Upstream time.Duration // time spent in the last backend
+	Total    time.Duration
+}
+
+// logEntryFrom returns the log entry for r,
+// or nil if r is not being logged.
+func logEntryFrom(r *http.Request) *logEntry {
+	e, _ := r.Context().Value(logEntryKey{}).(*logEntry)
+	return e
+}
+
+// accessLogHandler writes one line to the access log
+// for each request, after h has served it. It should be
+// wrapped by idHandler, so the request ID is set.
+// If drain is not nil, it also gets each entry.
+func accessLogHandler(h http.Handler, drain func(*logEntry)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := &logEntry{
+			Time:   time.Now(),
+			ID:     r.Header.Get("Id"),
+			Client: r.RemoteAddr,
+			Method: r.Method,
+			Host:   r.Host,
+			Path:   r.URL.Path,
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), logEntryKey{}, e)))
+		e.Total = time.Since(e.Time)
+		if sw.code != 0 {
+			e.Status = sw.code // else as set by the handler, e.g. 101
+		}
+		e.Bytes = sw.n
+		e.Upgraded = sw.hijacked
+		if accessLogFormat != "off" {
+			writeAccessLog(e)
+		}
+		if drain != nil {
+			drain(e)
+		}
+	})
+}
+
+func writeAccessLog(e *logEntry) {
+	var line []byte
+	if accessLogFormat == "logfmt" {
+		line = e.logfmt()
+	} else {
+		line = e.json()
+	}
+	accessLogMu.Lock()
+	defer accessLogMu.Unlock()
+	accessLogOut.Write(line)
+}
+
+// fields returns e's fields as key-value pairs, in order.
+func (e *logEntry) fields() [][2]interface{} {
+	f := [][2]interface{}{
+		{"time", e.Time.UTC().Format(time.RFC3339Nano)},
+		{"id", e.ID},
+		{"client", e.Client},
+		{"method", e.Method},
+		{"host", e.Host},
+		{"path", e.Path},
+		{"app", e.App},
+		{"backend", e.Backend},
+		{"tries", e.Tries},
+		{"status", e.Status},
+		{"bytes", e.Bytes},
+		{"upgraded", e.Upgraded},
+		{"upstream_ms", ms(e.Upstream)},
+		{"total_ms", ms(e.Total)},
+	}
+	if e.Err != "" {
+		f = append(f, [2]interface{}{"error", e.Err})
+	}
+	if e.TraceID != "" {
+		f = append(f, [2]interface{}{"trace_id", e.TraceID})
+	}
+	return f
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (e *logEntry) json() []byte {
+	return append(logline.JSON(e.fields()), '\n')
+}
+
+func (e *logEntry) logfmt() []byte {
+	return append(logline.Logfmt(e.fields()), '\n')
+}
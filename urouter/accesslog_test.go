@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(w io.Writer) { accessLogOut = w }(accessLogOut)
+	accessLogOut = &buf
+
+	h := idHandler(accessLogHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logEntryFrom(r).App = "foo"
+		w.WriteHeader(404)
+		w.Write([]byte("not found\n"))
+	}), nil))
+	r, _ := http.NewRequest("GET", "https://foo.webxapp.io/a/b", nil)
+	r.Header.Set("Id", "abc")
+	h.ServeHTTP(new(resp), r)
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"id":     "abc",
+		"app":    "foo",
+		"host":   "foo.webxapp.io",
+		"path":   "/a/b",
+		"status": float64(404),
+		"bytes":  float64(10),
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestAccessLogfmt(t *testing.T) {
+	e := &logEntry{ID: "abc", Path: "/a b", Status: 200}
+	s := string(e.logfmt())
+	for _, want := range []string{"id=abc", `path="/a b"`, "status=200", `app=""`} {
+		if !strings.Contains(s, want) {
+			t.Errorf("logfmt = %q, want it to contain %q", s, want)
+		}
+	}
+}
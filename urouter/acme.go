@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/kr/webx"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const defACMECache = "acme" // ACMECACHE
+
+// newACMEManager returns a certificate manager that gets
+// certificates for app domains and custom domains on demand,
+// from the ACME server with directory URL in env ACMEURL.
+// If ACMEURL is unset, it returns nil.
+//
+// Certificates go in the store named by env ACMECACHE.
+// To test against a local ACME server such as Pebble,
+// set env ACMECA to a file with the server's CA cert.
+func newACMEManager(dir *Directory) *autocert.Manager {
+	url := os.Getenv("ACMEURL")
+	if url == "" {
+		return nil
+	}
+	client := &acme.Client{DirectoryURL: url}
+	if file := os.Getenv("ACMECA"); file != "" {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatal("ACMECA: ", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			log.Fatal("ACMECA: no certificates in ", file)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      newCertCache(os.Getenv("ACMECACHE")),
+		HostPolicy: dir.hostPolicy,
+		Client:     client,
+		Email:      os.Getenv("ACMEEMAIL"),
+	}
+}
+
+// newCertCache returns the certificate store named by spec.
+// An empty spec means the default directory, defACMECache.
+// Anything else is a directory path. Other kinds of store
+// need only implement autocert.Cache.
+func newCertCache(spec string) autocert.Cache {
+	if spec == "" {
+		spec = defACMECache
+	}
+	return autocert.DirCache(spec)
+}
+
+// hostPolicy allows certificates only for hosts d can route:
+// custom domains, and app domains with a connected backend.
+// This keeps strangers from making us ask the ACME server
+// for certificates for arbitrary names.
+func (d *Directory) hostPolicy(ctx context.Context, host string) error {
+	if _, ok := d.domain(host); ok {
+		return nil
+	}
+	name := strings.TrimSuffix(host, "."+webx.AppDomain)
+	if name != host && d.Get(name) != nil {
+		return nil
+	}
+	return errors.New("acme: unknown host " + host)
+}
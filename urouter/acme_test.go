@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestHostPolicy(t *testing.T) {
+	d := &Directory{tab: make(map[string]*Group)}
+	d.Make("foo")
+	if err := d.SetDomains("foo", []string{"www.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		host string
+		ok   bool
+	}{
+		{"foo.webxapp.io", true},
+		{"www.example.com", true},
+		{"bar.webxapp.io", false},
+		{"foo", false},
+		{"example.com", false},
+	}
+	for _, test := range cases {
+		err := d.hostPolicy(context.Background(), test.host)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("hostPolicy(%q) = %v want ok=%v", test.host, err, test.ok)
+		}
+	}
+}
+
+// TestACMEPebble gets a certificate from a local Pebble server.
+// Run Pebble with PEBBLE_VA_ALWAYS_VALID=1, then set
+// ACMETESTURL (e.g. https://localhost:14000/dir) and
+// ACMETESTCA (Pebble's test/certs/pebble.minica.pem).
+func TestACMEPebble(t *testing.T) {
+	url := os.Getenv("ACMETESTURL")
+	if url == "" {
+		t.Skip("ACMETESTURL not set")
+	}
+	cache, err := ioutil.TempDir("", "urouter-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	os.Setenv("ACMEURL", url)
+	os.Setenv("ACMECA", os.Getenv("ACMETESTCA"))
+	os.Setenv("ACMECACHE", cache)
+	defer os.Unsetenv("ACMEURL")
+	defer os.Unsetenv("ACMECA")
+	defer os.Unsetenv("ACMECACHE")
+
+	d := &Directory{tab: make(map[string]*Group)}
+	d.Make("foo")
+	if err := d.SetDomains("foo", []string{"www.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	m := newACMEManager(d)
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("www.example.com"); err != nil {
+		t.Error(err)
+	}
+
+	// A second manager with the same store needn't ask Pebble.
+	m = newACMEManager(d)
+	m.Client = nil
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.example.com"}); err != nil {
+		t.Errorf("cached certificate: %v", err)
+	}
+}
@@ -1,44 +1,165 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/fernet/fernet-go"
 	"github.com/kr/spdy"
+	"github.com/kr/webx"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Backend struct {
-	conn   *spdy.Conn
+	outstanding int64 // requests in flight; accessed atomically
+	weight      int32 // accessed atomically
+	errs        int32 // consecutive 5xx responses; accessed atomically
+	retired     int32 // connection has ended; accessed atomically
+	rspdy       bool  // SPDY/3 connection, which can't carry trailers
+
+	conn   net.Conn // the backend's RSPDY or rh2 connection
 	client http.Client
 	proxy  httputil.ReverseProxy
 	WebsocketProxy
+
+	mu     sync.Mutex
+	groups []*Group // groups in which b should be routable
+	down   uint     // reasons b is not routable; see setDown
 }
 
+const replyTimeout = 10 * time.Second
+
+// NewBackend returns a backend for an RSPDY connection.
+// SPDY/3 as the spdy package speaks it has no trailers,
+// so the backend refuses requests that carry them.
 func NewBackend(c *spdy.Conn) *Backend {
+	var nc net.Conn
+	if c != nil {
+		nc = c.Conn
+	}
+	b := newBackend(nc, c)
+	b.rspdy = true
+	return b
+}
+
+// newBackend returns a backend that sends requests
+// with rt over connection c.
+func newBackend(c net.Conn, rt http.RoundTripper) *Backend {
 	b := new(Backend)
 	b.conn = c
-	b.client.Transport = c
-	b.proxy.Transport = c
-	b.proxy.Director = NopDirector
+	b.client.Transport = rt
+	b.proxy.Transport = rt
+	b.proxy.Rewrite = forwardRewrite
+	b.proxy.FlushInterval = -1 // stream responses as they come
+	b.proxy.ErrorHandler = b.proxyError
 	b.WebsocketProxy.handler = &b.proxy
-	b.WebsocketProxy.transport = c
+	b.WebsocketProxy.transport = rt
 	return b
 }
 
-func NopDirector(*http.Request) {}
+// proxyError handles transport errors from b's reverse proxy.
+// If the request can be retried, proxyError leaves the error
+// for Group.serveRetry instead of writing a response.
+func (b *Backend) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if a, ok := r.Context().Value(attemptKey{}).(*attempt); ok {
+		a.err = err
+		b.record(http.StatusBadGateway)
+		return
+	}
+	log.Println("error: proxy", b, err)
+	if e := logEntryFrom(r); e != nil {
+		e.Err = err.Error()
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// close closes b's connection.
+func (b *Backend) close() {
+	if b.conn != nil {
+		b.conn.Close()
+	}
+}
+
+func (b *Backend) String() string {
+	if b.conn == nil {
+		return "backend"
+	}
+	return b.conn.RemoteAddr().String()
+}
+
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if b.rspdy && r.Trailer != nil {
+		// The spdy package sends no trailers. Refuse the
+		// request rather than drop them; it isn't b's fault.
+		if e := logEntryFrom(r); e != nil {
+			e.Err = "trailers need an rh2 backend"
+		}
+		http.Error(w, "request trailers not supported by this app's connection", http.StatusNotImplemented)
+		return
+	}
+	atomic.AddInt64(&b.outstanding, 1)
+	label := b.String()
+	defer b.finish(label) // last, after all the metrics
+	backendInFlight.add(1, label)
+	defer backendInFlight.add(-1, label)
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	b.WebsocketProxy.ServeHTTP(sw, r)
+	if sw.code != 0 {
+		b.record(sw.code)
+	}
+	backendRequests.add(1, label, statusLabel(sw))
+	if !sw.hijacked {
+		backendLatency.observe(since(start), label)
+	}
+	if e := logEntryFrom(r); e != nil {
+		e.Backend = b.String()
+		e.Upstream = time.Since(start)
+		e.Tries++
+	}
+}
+
+// full reports whether b's connection can't take another
+// request now. An rh2 connection is full when all the
+// streams the backend allows are in use.
+func (b *Backend) full() bool {
+	t, ok := b.proxy.Transport.(interface{ CanTakeNewRequest() bool })
+	return ok && !t.CanTakeNewRequest()
+}
+
+// Outstanding returns the number of requests b is serving.
+func (b *Backend) Outstanding() int64 {
+	return atomic.LoadInt64(&b.outstanding)
+}
+
+// Weight returns the relative share of traffic b wants,
+// as sent in its handshake. The default weight is 1.
+func (b *Backend) Weight() int {
+	if w := atomic.LoadInt32(&b.weight); w > 0 {
+		return int(w)
+	}
+	return 1
+}
 
 func (b *Backend) Handshake(dir *Directory) {
-	resp, err := b.client.Get("https://backend.webx.io/names")
+	resp, err := b.client.Get("https://" + webx.BackendHost + "/names")
 	if err != nil {
 		log.Println("error: get backend names:", err)
+		handshakeFailures.add(1, "error")
 		return
 	}
 	if resp.StatusCode != 200 {
 		log.Println("error: get backend names http status", resp.Status)
+		handshakeFailures.add(1, "status")
 		return
 	}
 	var names []string
@@ -46,16 +167,48 @@ func (b *Backend) Handshake(dir *Directory) {
 		for _, s := range names {
 			log.Println("remove", s)
 			if g := dir.Get(s); g != nil {
+				b.removeRoute(g)
 				g.Remove(b)
 			}
 		}
 	}()
+
+	// Until the backend adds a name with a good token,
+	// it gets no health checks and can't drain, and a bad
+	// token closes the connection. Close it only after
+	// the replies are out, so the backend learns why.
+	var authorized, hangup bool
+	defer func() {
+		if hangup {
+			b.close()
+		}
+	}()
+	replies := make(chan webx.Reply, 16)
+	sent := make(chan bool)
+	go func() {
+		b.sendReplies(replies)
+		close(sent)
+	}()
+	defer func() {
+		close(replies)
+		<-sent
+	}()
+	var healthDone chan bool
+	defer func() {
+		if healthDone != nil {
+			close(healthDone)
+		}
+	}()
+
 	d := json.NewDecoder(resp.Body)
-	var cmd struct {
-		Op    string // e.g. "add" or "remove"
-		Token string `json:"Password"`
-	}
 	for {
+		var cmd struct {
+			Op     string // e.g. "add" or "remove"
+			Name   string // only for replies; the token has the real name
+			Token  string `json:"Password"`
+			Weight int32
+			Ack    bool
+		}
 		err := d.Decode(&cmd)
 		if err != nil {
 			if err != io.EOF {
@@ -63,19 +216,57 @@ func (b *Backend) Handshake(dir *Directory) {
 			}
 			return
 		}
+		if cmd.Op == "drain" {
+			if !authorized {
+				log.Println("drain before add", b)
+				hangup = true
+				return
+			}
+			log.Println("drain", b)
+			b.setDown(downDrain)
+			go b.closeWhenIdle()
+			continue
+		}
+		rep := webx.Reply{Op: cmd.Op, Name: cmd.Name}
 		msg := fernet.VerifyAndDecrypt([]byte(cmd.Token), time.Hour*24*365, fernetKeys)
 		if msg == nil {
-			return // unauthorized
+			log.Println("unauthorized", cmd.Op, cmd.Name, b)
+			handshakeFailures.add(1, "unauthorized")
+			rep.Error = "unauthorized"
+			if !cmd.Ack {
+				hangup = true
+				return // the client can't tell, so it can't fix it
+			}
+			replies <- rep
+			if len(names) == 0 {
+				hangup = true
+				return
+			}
+			continue
 		}
 
 		name := string(msg)
+		if (cmd.Op == "add" || cmd.Op == "mon") && stringsContain(names, name) {
+			if cmd.Ack {
+				replies <- rep
+			}
+			continue // already added on this connection
+		}
 		switch cmd.Op {
 		case "add":
 			log.Println("add", name)
+			if cmd.Weight > 0 {
+				atomic.StoreInt32(&b.weight, cmd.Weight)
+			}
 			g := dir.Make(name)
 			g.Add(b)
-			g.AddRoute(b)
+			b.addRoute(g)
 			names = append(names, name)
+			if !authorized {
+				authorized = true
+				healthDone = make(chan bool)
+				go b.checkHealth(healthDone)
+			}
 		case "mon":
 			log.Println("mon", name)
 			dir.Make(name).Add(b)
@@ -83,13 +274,152 @@ func (b *Backend) Handshake(dir *Directory) {
 		case "remove":
 			log.Println("remove", name)
 			if g := dir.Get(name); g != nil {
+				b.removeRoute(g)
 				g.Remove(b)
 			}
 			names = stringsRemove(names, name)
+		default:
+			log.Println("unknown op", cmd.Op, b)
+			rep.Error = "unknown op " + cmd.Op
+		}
+		if cmd.Ack {
+			replies <- rep
 		}
 	}
 }
 
+// sendReplies sends each reply from c to b, in order,
+// until c is closed.
+func (b *Backend) sendReplies(c <-chan webx.Reply) {
+	for rep := range c {
+		if err := b.sendReply(rep); err != nil {
+			log.Println("error: send reply:", b, err)
+		}
+	}
+}
+
+func (b *Backend) sendReply(rep webx.Reply) error {
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+	defer cancel()
+	url := "https://" + webx.BackendHost + "/names/reply"
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return errors.New("http status " + resp.Status)
+	}
+	return nil
+}
+
+// Reasons a backend can be down.
+const (
+	downHealth  = 1 << iota // failed health checks
+	downOutlier             // too many errors; see record
+	downDrain               // backend asked to drain
+)
+
+// addRoute makes b routable in g. If b is down, g holds it
+// ejected until b comes back up.
+func (b *Backend) addRoute(g *Group) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.groups = append(b.groups, g)
+	if b.down == 0 {
+		g.AddRoute(b)
+	} else {
+		g.Eject(b, b.failing())
+	}
+}
+
+// removeRoute forgets that b should be routable in g.
+// It does not remove b from g; see Group.Remove. Call it
+// before Group.Remove, so a concurrent setDown or setUp
+// can't leave b behind in g's ejected or routable list.
+func (b *Backend) removeRoute(g *Group) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.groups = groupsRemove(b.groups, g)
+}
+
+// setDown marks b down for the given reason. If b was
+// up, setDown ejects it from all its groups.
+func (b *Backend) setDown(reason uint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	was := b.down
+	b.down |= reason
+	if was == 0 {
+		log.Println("eject", b)
+	}
+	if b.down != was {
+		for _, g := range b.groups {
+			g.Eject(b, b.failing())
+		}
+	}
+}
+
+// setUp clears the given reason for b to be down. If that
+// was the last reason, setUp restores b to all its groups.
+func (b *Backend) setUp(reason uint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down == 0 {
+		return
+	}
+	was := b.down
+	b.down &^= reason
+	if b.down == 0 {
+		log.Println("restore", b)
+		for _, g := range b.groups {
+			g.Restore(b)
+		}
+	} else if b.down != was {
+		for _, g := range b.groups {
+			g.Eject(b, b.failing())
+		}
+	}
+}
+
+// failing reports whether b is down only for errors, so
+// its groups may still use it if nothing else is left.
+// It must be called with b.mu held.
+func (b *Backend) failing() bool {
+	return b.down&downDrain == 0
+}
+
+// groupsRemove destructively removes elements of a that
+// equal g and returns the resulting slice.
+func groupsRemove(a []*Group, g *Group) []*Group {
+	i := 0
+	for _, t := range a {
+		if t != g {
+			a[i] = t
+			i++
+		}
+	}
+	return a[:i]
+}
+
+func stringsContain(a []string, s string) bool {
+	for _, t := range a {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
 // stringsRemove destructively removes elements of a that
 // equal s and returns the resulting slice.
 func stringsRemove(a []string, s string) []string {
@@ -102,3 +432,48 @@ func stringsRemove(a []string, s string) []string {
 	}
 	return a[:i]
 }
+
+// statusWriter records the status code and the number
+// of body bytes written to it. It passes through Flush
+// and Hijack, and Unwrap gives the writer it wraps.
+type statusWriter struct {
+	http.ResponseWriter
+	code     int
+	n        int64
+	hijacked bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	w.hijacked = true
+	return hj.Hijack()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kr/webx"
+)
+
+func TestSendReply(t *testing.T) {
+	var got webx.Reply
+	var path string
+	b := NewBackend(nil)
+	b.client.Transport = funcTransport(func(r *http.Request) (*http.Response, error) {
+		path = r.URL.Path
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		return statusTransport(200).RoundTrip(r)
+	})
+	want := webx.Reply{Op: "add", Name: "foo", Error: "unauthorized"}
+	if err := b.sendReply(want); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/names/reply" {
+		t.Errorf("path = %q want /names/reply", path)
+	}
+	if got != want {
+		t.Errorf("reply = %+v want %+v", got, want)
+	}
+
+	b.client.Transport = statusTransport(404)
+	if err := b.sendReply(want); err == nil {
+		t.Error("expected error for 404")
+	}
+}
+
+func TestHandshakeUnauthorized(t *testing.T) {
+	cases := []struct {
+		cmds    string
+		replies int
+	}{
+		{`{"Op":"add","Name":"foo","Password":"bad"}`, 0},
+		{`{"Op":"add","Name":"foo","Password":"bad","Ack":true}`, 1},
+		{`{"Op":"drain"}`, 0},
+	}
+	for i, test := range cases {
+		c, peer := net.Pipe()
+		stay, _ := io.Pipe() // the names stream stays open
+		var replies []webx.Reply
+		b := newBackend(c, funcTransport(func(r *http.Request) (*http.Response, error) {
+			if r.URL.Path == "/names/reply" {
+				var rep webx.Reply
+				json.NewDecoder(r.Body).Decode(&rep)
+				replies = append(replies, rep) // before Handshake returns
+				return statusTransport(200).RoundTrip(r)
+			}
+			body := io.MultiReader(strings.NewReader(test.cmds), stay)
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(body)}, nil
+		}))
+		done := make(chan bool)
+		go func() {
+			b.Handshake(&Directory{tab: make(map[string]*Group)})
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d: Handshake kept an unauthorized connection", i)
+		}
+		if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%d: conn read = %v want EOF", i, err)
+		}
+		if len(replies) != test.replies {
+			t.Errorf("%d: %d replies want %d", i, len(replies), test.replies)
+		}
+		for _, rep := range replies {
+			if rep.Error != "unauthorized" {
+				t.Errorf("%d: reply %+v want unauthorized", i, rep)
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+)
+
+const defBalancer = "p2c"
+
+// A Balancer chooses one Backend from a non-empty list
+// of routable backends. Balancers must be safe to call
+// from multiple goroutines.
+type Balancer interface {
+	Pick(a []*Backend) *Backend
+}
+
+// newBalancer returns a new Balancer for the named strategy,
+// or nil if there is no such strategy.
+func newBalancer(strategy string) Balancer {
+	switch strategy {
+	case "random":
+		return Random{}
+	case "rr", "round-robin":
+		return new(RoundRobin)
+	case "least", "least-outstanding":
+		return LeastOutstanding{}
+	case "p2c", "power-of-two":
+		return PowerOfTwo{}
+	case "weighted":
+		return Weighted{}
+	}
+	return nil
+}
+
+// Random picks a backend uniformly at random.
+type Random struct{}
+
+func (Random) Pick(a []*Backend) *Backend {
+	return a[rand.Intn(len(a))]
+}
+
+// RoundRobin picks each backend in turn.
+type RoundRobin struct {
+	n uint32
+}
+
+func (rr *RoundRobin) Pick(a []*Backend) *Backend {
+	n := atomic.AddUint32(&rr.n, 1) - 1
+	return a[n%uint32(len(a))]
+}
+
+// LeastOutstanding picks the backend with the fewest
+// requests in flight. Ties are broken at random.
+type LeastOutstanding struct{}
+
+func (LeastOutstanding) Pick(a []*Backend) *Backend {
+	var best *Backend
+	var min int64
+	nbest := 0
+	for _, b := range a {
+		n := b.Outstanding()
+		switch {
+		case best == nil || n < min:
+			best, min, nbest = b, n, 1
+		case n == min:
+			// reservoir sampling over the tied backends
+			nbest++
+			if rand.Intn(nbest) == 0 {
+				best = b
+			}
+		}
+	}
+	return best
+}
+
+// PowerOfTwo picks two backends at random and
+// uses the one with fewer requests in flight.
+type PowerOfTwo struct{}
+
+func (PowerOfTwo) Pick(a []*Backend) *Backend {
+	if len(a) == 1 {
+		return a[0]
+	}
+	i := rand.Intn(len(a))
+	j := rand.Intn(len(a) - 1)
+	if j >= i {
+		j++
+	}
+	if a[j].Outstanding() < a[i].Outstanding() {
+		return a[j]
+	}
+	return a[i]
+}
+
+// Weighted picks a backend at random, in proportion
+// to the weight each backend sent in its handshake.
+type Weighted struct{}
+
+func (Weighted) Pick(a []*Backend) *Backend {
+	total := 0
+	for _, b := range a {
+		total += b.Weight()
+	}
+	n := rand.Intn(total)
+	for _, b := range a {
+		if n -= b.Weight(); n < 0 {
+			return b
+		}
+	}
+	panic("unreached")
+}
+
+// balancerTable maps app names to load-balancing strategies.
+// Key "*" gives the strategy for apps not listed.
+type balancerTable map[string]string
+
+// parseBalancers parses s, a comma-separated list of
+// name=strategy pairs, e.g. "*=p2c,foo=rr".
+func parseBalancers(s string) (balancerTable, error) {
+	t := make(balancerTable)
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		p := strings.Index(f, "=")
+		if p < 0 {
+			return nil, errors.New("bad balancer: " + f)
+		}
+		name, strategy := f[:p], f[p+1:]
+		if newBalancer(strategy) == nil {
+			return nil, errors.New("bad balancer: " + f)
+		}
+		t[name] = strategy
+	}
+	return t, nil
+}
+
+// New returns a new Balancer for app name.
+func (t balancerTable) New(name string) Balancer {
+	s, ok := t[name]
+	if !ok {
+		s, ok = t["*"]
+	}
+	if !ok {
+		s = defBalancer
+	}
+	return newBalancer(s)
+}
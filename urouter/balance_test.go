@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRoundRobin(t *testing.T) {
+	a := []*Backend{NewBackend(nil), NewBackend(nil), NewBackend(nil)}
+	rr := new(RoundRobin)
+	for i := 0; i < 2*len(a); i++ {
+		if b := rr.Pick(a); b != a[i%len(a)] {
+			t.Errorf("pick %d = %p want %p", i, b, a[i%len(a)])
+		}
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	a := []*Backend{NewBackend(nil), NewBackend(nil), NewBackend(nil)}
+	a[0].outstanding = 3
+	a[1].outstanding = 1
+	a[2].outstanding = 2
+	for i := 0; i < 10; i++ {
+		if b := (LeastOutstanding{}).Pick(a); b != a[1] {
+			t.Fatalf("b = %p want %p", b, a[1])
+		}
+	}
+}
+
+func TestPowerOfTwo(t *testing.T) {
+	a := []*Backend{NewBackend(nil), NewBackend(nil)}
+	a[0].outstanding = 5
+	for i := 0; i < 10; i++ {
+		if b := (PowerOfTwo{}).Pick(a); b != a[1] {
+			t.Fatalf("b = %p want %p", b, a[1])
+		}
+	}
+	a = a[:1]
+	if b := (PowerOfTwo{}).Pick(a); b != a[0] {
+		t.Fatalf("b = %p want %p", b, a[0])
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	a := []*Backend{NewBackend(nil), NewBackend(nil)}
+	a[1].weight = 3
+	n := 0
+	const runs = 10000
+	for i := 0; i < runs; i++ {
+		if (Weighted{}).Pick(a) == a[1] {
+			n++
+		}
+	}
+	if n < runs*7/10 || n > runs*8/10 {
+		t.Errorf("heavy backend picked %d/%d times want about 3/4", n, runs)
+	}
+}
+
+func TestParseBalancers(t *testing.T) {
+	tab, err := parseBalancers("*=rr, foo=least")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tab.New("foo").(LeastOutstanding); !ok {
+		t.Errorf("foo balancer = %T want LeastOutstanding", tab.New("foo"))
+	}
+	if _, ok := tab.New("bar").(*RoundRobin); !ok {
+		t.Errorf("bar balancer = %T want *RoundRobin", tab.New("bar"))
+	}
+	if _, ok := balancerTable(nil).New("bar").(PowerOfTwo); !ok {
+		t.Errorf("default balancer = %T want PowerOfTwo", balancerTable(nil).New("bar"))
+	}
+
+	for _, s := range []string{"foo", "foo=bogus"} {
+		if _, err := parseBalancers(s); err == nil {
+			t.Errorf("parseBalancers(%q) err = nil want error", s)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A certStore holds the certificates for the public TLS
+// listener and picks one for each connection by SNI.
+//
+// It loads the default certificate from certFile and
+// keyFile, plus every pair name.crt and name.key in dir,
+// if dir is set. Each certificate serves the names in
+// its DNSNames, which may include wildcards.
+type certStore struct {
+	certFile string
+	keyFile  string
+	dir      string            // CERTDIR
+	acme     *autocert.Manager // or nil
+
+	mu    sync.RWMutex
+	def   *tls.Certificate
+	names map[string]*tls.Certificate // e.g. "www.example.com" or "*.example.com"
+}
+
+// load reads all certificates from disk. If there is
+// an error, s keeps the certificates it had before.
+func (s *certStore) load() error {
+	def, err := loadCert(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]*tls.Certificate)
+	if s.dir != "" {
+		files, err := filepath.Glob(filepath.Join(s.dir, "*.crt"))
+		if err != nil {
+			return err
+		}
+		for _, crt := range files {
+			cert, err := loadCert(crt, strings.TrimSuffix(crt, ".crt")+".key")
+			if err != nil {
+				return err
+			}
+			for _, name := range cert.Leaf.DNSNames {
+				names[strings.ToLower(name)] = cert
+			}
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.def = def
+	s.names = names
+	return nil
+}
+
+func loadCert(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// reloadOnHangup reloads s whenever the process gets SIGHUP.
+func (s *certStore) reloadOnHangup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := s.load(); err != nil {
+			log.Println("error: reload certs:", err)
+			continue
+		}
+		log.Println("reloaded certs")
+	}
+}
+
+// lookup returns the certificate for host name,
+// matching first exactly, then by wildcard.
+// It returns nil if there's no such certificate.
+func (s *certStore) lookup(name string) *tls.Certificate {
+	name = strings.ToLower(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if cert := s.names[name]; cert != nil {
+		return cert
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		return s.names["*"+name[i:]]
+	}
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+// Certificates on disk take precedence over ACME, so
+// an operator can always override what ACME provides.
+// If neither has a certificate for the name in hello,
+// GetCertificate uses the default certificate.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if s.acme != nil && isACMEChallenge(hello) {
+		return s.acme.GetCertificate(hello)
+	}
+	if cert := s.lookup(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	if s.acme != nil && hello.ServerName != "" {
+		cert, err := s.acme.GetCertificate(hello)
+		if err == nil {
+			return cert, nil
+		}
+		log.Println("acme:", hello.ServerName, err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.def == nil {
+		return nil, errors.New("no certificate for " + hello.ServerName)
+	}
+	return s.def, nil
+}
+
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for names
+// to dir/base.crt and dir/base.key.
+func writeCert(t *testing.T, dir, base string, names ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, base+".crt"), crt, 0600); err != nil {
+		t.Fatal(err)
+	}
+	k := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+	if err := ioutil.WriteFile(filepath.Join(dir, base+".key"), k, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertStore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "urouter-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "certs")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeCert(t, tmp, "outer", "default.example")
+	writeCert(t, dir, "wild", "*.webxapp.io")
+	writeCert(t, dir, "custom", "www.example.com")
+
+	s := &certStore{
+		certFile: filepath.Join(tmp, "outer.crt"),
+		keyFile:  filepath.Join(tmp, "outer.key"),
+		dir:      dir,
+	}
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		sni  string
+		name string
+	}{
+		{"foo.webxapp.io", "*.webxapp.io"},
+		{"WWW.Example.com", "www.example.com"},
+		{"example.com", "default.example"},
+		{"", "default.example"},
+	}
+	for _, test := range cases {
+		cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: test.sni})
+		if err != nil {
+			t.Errorf("GetCertificate(%q) err = %v", test.sni, err)
+			continue
+		}
+		if g := cert.Leaf.DNSNames[0]; g != test.name {
+			t.Errorf("GetCertificate(%q) = %q want %q", test.sni, g, test.name)
+		}
+	}
+
+	// reload picks up new certificates and keeps
+	// the old ones if there's an error
+	writeCert(t, dir, "other", "example.com")
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+	if cert := s.lookup("example.com"); cert == nil {
+		t.Error("example.com not found after reload")
+	}
+	if err := os.Remove(filepath.Join(dir, "other.key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.load(); err == nil {
+		t.Error("expected error loading cert with missing key")
+	}
+	if cert := s.lookup("example.com"); cert == nil {
+		t.Error("example.com not found after failed reload")
+	}
+}
@@ -1,21 +1,33 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"github.com/fernet/fernet-go"
 	"github.com/kr/spdy"
+	"github.com/kr/webx"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
 type Directory struct {
-	tab map[string]*Group
-	mu  sync.RWMutex
+	tab     map[string]*Group
+	domains map[string]string    // custom domain -> app name
+	drains  map[string]*logDrain // app name -> log drain
+	mu      sync.RWMutex
+	saveMu  sync.Mutex // serializes saveDomains and saveDrains
 }
 
 func (d *Directory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -31,15 +43,79 @@ func (d *Directory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // It makes a new backend to represent the conn,
 // then starts the handshake process.
 func (d *Directory) ServeRSPDY(s *http.Server, c *tls.Conn, h http.Handler) {
-	b := NewBackend(&spdy.Conn{Conn: c})
+	d.serveBackend(NewBackend(&spdy.Conn{Conn: c}))
+}
+
+// serveBackend runs b's handshake until its connection ends.
+func (d *Directory) serveBackend(b *Backend) {
+	backendConns.add(1)
+	defer backendConns.add(-1)
+	defer b.retire()
 	b.Handshake(d)
 }
 
 // pick chooses the appropriate Group for r, based on the Host
 // header field. If there is no such Group, pick returns nil.
 func (d *Directory) pick(r *http.Request) *Group {
-	name := strings.TrimSuffix(basehost(r.Host), ".webxapp.io")
-	return d.Get(name)
+	host := basehost(r.Host)
+	if name := strings.TrimSuffix(host, "."+webx.AppDomain); name != host {
+		return d.Get(name) // never a custom domain; see SetDomains
+	}
+	if name, ok := d.domain(host); ok {
+		return d.Get(name)
+	}
+	return d.Get(host)
+}
+
+// domain looks up host in the custom domain table.
+func (d *Directory) domain(host string) (name string, ok bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	name, ok = d.domains[strings.ToLower(host)]
+	return name, ok
+}
+
+// SetDomains replaces the custom domains for app name
+// with hosts. It returns an error if any of hosts
+// already belongs to another app, or is one of the
+// service's own; see webx.ReservedHost.
+func (d *Directory) SetDomains(name string, hosts []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, h := range hosts {
+		if webx.ReservedHost(h) {
+			return errors.New("domain " + h + " is reserved")
+		}
+		if other, ok := d.domains[strings.ToLower(h)]; ok && other != name {
+			return errors.New("domain " + h + " belongs to another app")
+		}
+	}
+	if d.domains == nil {
+		d.domains = make(map[string]string)
+	}
+	for h, s := range d.domains {
+		if s == name {
+			delete(d.domains, h)
+		}
+	}
+	for _, h := range hosts {
+		d.domains[strings.ToLower(h)] = name
+	}
+	return nil
+}
+
+// DomainsFor returns the custom domains for app name.
+func (d *Directory) DomainsFor(name string) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	hosts := []string{}
+	for h, s := range d.domains {
+		if s == name {
+			hosts = append(hosts, h)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
 }
 
 func (d *Directory) Get(name string) *Group {
@@ -57,7 +133,7 @@ func (d *Directory) Make(name string) *Group {
 	if g := d.tab[name]; g != nil {
 		return g
 	}
-	g := new(Group)
+	g := &Group{name: name, balancer: balancers.New(name)}
 	d.tab[name] = g
 	return g
 }
@@ -85,11 +161,108 @@ func (d *Directory) Monitor(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	r.Host = "backend.webx.io"
+	r.Host = webx.BackendHost
 	r.URL.Host = r.Host
 	g.Monitor(w, r)
 }
 
+// Domains serves the custom domain table for one app.
+// GET lists the app's domains; PUT replaces them with
+// the JSON list of host names in the request body.
+//
+// The app is named by a fernet token in the password of
+// the Authorization header. This token is not the one
+// the app's backends use; it signs "domains:" plus the
+// app name, so only the API, not app owners, can make
+// one. Otherwise an app could claim another's domain.
+func (d *Directory) Domains(w http.ResponseWriter, r *http.Request) {
+	_, tok := basicAuth(r.Header.Get("Authorization"))
+	msg := fernet.VerifyAndDecrypt([]byte(tok), time.Hour*24*365, fernetKeys)
+	if !bytes.HasPrefix(msg, []byte("domains:")) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	name := string(msg[len("domains:"):])
+	switch r.Method {
+	case "GET", "HEAD":
+		json.NewEncoder(w).Encode(d.DomainsFor(name))
+	case "PUT":
+		var hosts []string
+		if err := json.NewDecoder(r.Body).Decode(&hosts); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if err := d.SetDomains(name, hosts); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Println("domains", name, hosts)
+		if err := d.saveDomains(); err != nil {
+			log.Println("error: save domains:", err)
+		}
+		json.NewEncoder(w).Encode(d.DomainsFor(name))
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// loadDomains reads the custom domain table from domainFile.
+// It is not an error if the file doesn't exist.
+func (d *Directory) loadDomains() error {
+	if domainFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(domainFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return json.Unmarshal(b, &d.domains)
+}
+
+// saveDomains writes the custom domain table to domainFile,
+// so it survives a restart.
+func (d *Directory) saveDomains() error {
+	if domainFile == "" {
+		return nil
+	}
+	// Hold saveMu from Marshal to Rename, so an older
+	// table can't replace a newer one.
+	d.saveMu.Lock()
+	defer d.saveMu.Unlock()
+	d.mu.RLock()
+	b, err := json.Marshal(d.domains)
+	d.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(domainFile, b)
+}
+
+// writeFileAtomic writes b to a temporary file next to name
+// and renames it to name, so readers never see a partial file.
+func writeFileAtomic(name string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
 func basicAuth(h string) (username, password string) {
 	if !strings.HasPrefix(h, "Basic ") {
 		return
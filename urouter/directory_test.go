@@ -1,7 +1,13 @@
 package main
 
 import (
+	"github.com/kr/webx"
 	"net/http"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -37,3 +43,87 @@ func TestDirectoryEmptyResp(t *testing.T) {
 		t.Errorf("code = %d want 404", w.code)
 	}
 }
+
+func TestDirectoryCustomDomain(t *testing.T) {
+	d := &Directory{tab: make(map[string]*Group)}
+	w := d.Make("foo")
+	if err := d.SetDomains("foo", []string{"WWW.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	g := d.pick(&http.Request{Host: "www.example.com:443"})
+	if g != w {
+		t.Fatalf("g = %v want %v", g, w)
+	}
+
+	err := d.SetDomains("bar", []string{"www.example.com"})
+	if err == nil {
+		t.Fatal("expected error claiming another app's domain")
+	}
+
+	if err := d.SetDomains("foo", []string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if g := d.pick(&http.Request{Host: "www.example.com"}); g != nil {
+		t.Errorf("g = %v want nil", g)
+	}
+	if hosts := d.DomainsFor("foo"); len(hosts) != 1 || hosts[0] != "example.com" {
+		t.Errorf("DomainsFor(foo) = %q want [example.com]", hosts)
+	}
+}
+
+func TestDirectoryReservedDomain(t *testing.T) {
+	d := &Directory{tab: make(map[string]*Group)}
+	d.Make("a")
+	b := d.Make("b")
+	for _, h := range []string{
+		"b." + webx.AppDomain,
+		"B." + strings.ToUpper(webx.AppDomain),
+		webx.AppDomain,
+		webx.RouteHost,
+		webx.APIHost,
+		webx.BackendHost,
+	} {
+		if err := d.SetDomains("a", []string{h}); err == nil {
+			t.Errorf("app a claimed %s", h)
+		}
+	}
+	if g := d.pick(&http.Request{Host: "b." + webx.AppDomain}); g != b {
+		t.Errorf("pick = %v want b", g)
+	}
+	// A table saved before reserved hosts were refused
+	// can't divert an app's own name either.
+	d.domains = map[string]string{"b." + webx.AppDomain: "a"}
+	if g := d.pick(&http.Request{Host: "b." + webx.AppDomain}); g != b {
+		t.Errorf("pick = %v want b", g)
+	}
+}
+
+func TestSaveDomains(t *testing.T) {
+	defer func(s string) { domainFile = s }(domainFile)
+	domainFile = filepath.Join(t.TempDir(), "domains.json")
+	d := &Directory{tab: make(map[string]*Group)}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d.SetDomains("app"+strconv.Itoa(i), []string{"www" + strconv.Itoa(i) + ".example.com"})
+			if err := d.saveDomains(); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	e := new(Directory)
+	if err := e.loadDomains(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(e.domains, d.domains) {
+		t.Errorf("loaded %v want %v", e.domains, d.domains)
+	}
+	files, _ := filepath.Glob(domainFile + "*")
+	if len(files) != 1 {
+		t.Errorf("files = %v want just %s", files, domainFile)
+	}
+}
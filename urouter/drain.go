@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const defDrainTimeout = 30 * time.Second // DRAINTIMEOUT
+
+var drainTimeout = defDrainTimeout
+
+// closeWhenIdle closes b's connection once it has no
+// requests in flight, or after drainTimeout, whichever
+// comes first. It should be called after b has been
+// taken out of its groups, so no new requests arrive.
+func (b *Backend) closeWhenIdle() {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	deadline := time.After(drainTimeout)
+	for idle := 0; idle < 2; {
+		select {
+		case <-deadline:
+			log.Println("drain timeout", b, b.Outstanding(), "requests in flight")
+			b.close()
+			return
+		case <-t.C:
+			// Look twice, in case a request was routed
+			// to b just before it was ejected.
+			if b.Outstanding() == 0 {
+				idle++
+			} else {
+				idle = 0
+			}
+		}
+	}
+	log.Println("drained", b)
+	b.close()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDrainTimeout(t *testing.T) {
+	defer func(d time.Duration) { drainTimeout = d }(drainTimeout)
+	drainTimeout = 10 * time.Millisecond
+
+	b := NewBackend(nil)
+	b.outstanding = 1
+	done := make(chan bool)
+	go func() {
+		b.closeWhenIdle()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("closeWhenIdle did not time out")
+	}
+}
+
+func TestDrainEject(t *testing.T) {
+	b := NewBackend(nil)
+	g := new(Group)
+	b.addRoute(g)
+	b.setDown(downDrain)
+	b.setUp(downHealth)
+	if n := len(g.routable); n != 0 {
+		t.Errorf("len(g.routable) = %d want 0", n)
+	}
+}
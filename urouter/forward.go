@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// trustForward says whose X-Forwarded-For, X-Forwarded-Proto,
+// and Forwarded header fields to believe. By default, the
+// router strips them from incoming requests, since anyone
+// can send them. If the router sits behind a load balancer,
+// set TRUSTFORWARD to its addresses, as a comma-separated
+// list of CIDR blocks, or to "*" to trust every client.
+var trustForward []*net.IPNet // TRUSTFORWARD
+
+// parseTrust parses the TRUSTFORWARD list.
+// Bare IP addresses are taken as single hosts.
+func parseTrust(s string) ([]*net.IPNet, error) {
+	var a []*net.IPNet
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if f == "*" {
+			_, v4, _ := net.ParseCIDR("0.0.0.0/0")
+			_, v6, _ := net.ParseCIDR("::/0")
+			a = append(a, v4, v6)
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, errors.New("bad address: " + f)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			a = append(a, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, n)
+	}
+	return a, nil
+}
+
+func trusted(ip net.IP) bool {
+	for _, n := range trustForward {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardHandler sets X-Forwarded-For, X-Forwarded-Proto,
+// and Forwarded (RFC 7239) in r to describe the client,
+// so the backend can see them. If the client is trusted,
+// the values it sent are kept, with the client appended;
+// otherwise they are replaced, and X-Forwarded-Host
+// is removed.
+func forwardHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setForwarded(r)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func setForwarded(r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	var xff, fwd []string
+	if ip != nil && trusted(ip) {
+		xff = r.Header["X-Forwarded-For"]
+		fwd = r.Header["Forwarded"]
+		if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+			proto = p
+		}
+	} else {
+		r.Header.Del("X-Forwarded-Host")
+	}
+	r.Header.Del("X-Forwarded-For")
+	r.Header.Del("X-Forwarded-Proto")
+	r.Header.Del("Forwarded")
+	if ip != nil {
+		xff = append(xff, ip.String())
+	}
+	r.Header.Set("X-Forwarded-For", strings.Join(xff, ", "))
+	r.Header.Set("X-Forwarded-Proto", proto)
+	elem := "for=" + forwardedNode(ip) + ";proto=" + proto
+	if r.Host != "" {
+		elem += ";host=" + quoteForwarded(r.Host)
+	}
+	r.Header.Set("Forwarded", strings.Join(append(fwd, elem), ", "))
+}
+
+// forwardedNode formats ip as a node in a Forwarded
+// header field. IPv6 addresses must be bracketed and
+// quoted; an unknown address is "unknown".
+func forwardedNode(ip net.IP) string {
+	switch {
+	case ip == nil:
+		return "unknown"
+	case ip.To4() == nil:
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.String()
+}
+
+func quoteForwarded(s string) string {
+	for _, c := range s {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+		}
+	}
+	return s
+}
+
+// forwardRewrite is the Rewrite func for Backend's reverse
+// proxy. It sends the request on as it is, with the
+// forwarding header fields set by forwardHandler, which
+// ReverseProxy would otherwise drop.
+func forwardRewrite(pr *httputil.ProxyRequest) {
+	for _, k := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+		if v, ok := pr.In.Header[k]; ok {
+			pr.Out.Header[k] = v
+		}
+	}
+	// Out.Trailer is a copy, but net/http fills in
+	// In.Trailer as the body is read. Share it, so
+	// request trailers reach the backend.
+	pr.Out.Trailer = pr.In.Trailer
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestSetForwarded(t *testing.T) {
+	defer func(a []*net.IPNet) { trustForward = a }(trustForward)
+	var err error
+	trustForward, err = parseTrust("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		remote string
+		tls    bool
+		in     http.Header
+		xff    string
+		proto  string
+		fwd    string
+	}{
+		{
+			remote: "1.2.3.4:5678",
+			in:     http.Header{"X-Forwarded-For": {"6.6.6.6"}, "X-Forwarded-Proto": {"https"}},
+			xff:    "1.2.3.4",
+			proto:  "http",
+			fwd:    "for=1.2.3.4;proto=http;host=foo.webxapp.io",
+		},
+		{
+			remote: "1.2.3.4:5678",
+			tls:    true,
+			xff:    "1.2.3.4",
+			proto:  "https",
+			fwd:    "for=1.2.3.4;proto=https;host=foo.webxapp.io",
+		},
+		{
+			remote: "10.1.2.3:5678",
+			in: http.Header{
+				"X-Forwarded-For":   {"5.5.5.5"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {"for=5.5.5.5;proto=https"},
+			},
+			xff:   "5.5.5.5, 10.1.2.3",
+			proto: "https",
+			fwd:   "for=5.5.5.5;proto=https, for=10.1.2.3;proto=https;host=foo.webxapp.io",
+		},
+		{
+			remote: "[2001:db8::1]:5678",
+			xff:    "2001:db8::1",
+			proto:  "http",
+			fwd:    `for="[2001:db8::1]";proto=http;host=foo.webxapp.io`,
+		},
+	}
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "http://foo.webxapp.io/", nil)
+		r.RemoteAddr = c.remote
+		if c.tls {
+			r.TLS = new(tls.ConnectionState)
+		}
+		for k, v := range c.in {
+			r.Header[k] = v
+		}
+		setForwarded(r)
+		if g := r.Header.Get("X-Forwarded-For"); g != c.xff {
+			t.Errorf("%s: X-Forwarded-For = %q want %q", c.remote, g, c.xff)
+		}
+		if g := r.Header.Get("X-Forwarded-Proto"); g != c.proto {
+			t.Errorf("%s: X-Forwarded-Proto = %q want %q", c.remote, g, c.proto)
+		}
+		if g := r.Header.Get("Forwarded"); g != c.fwd {
+			t.Errorf("%s: Forwarded = %q want %q", c.remote, g, c.fwd)
+		}
+	}
+}
+
+func TestParseTrust(t *testing.T) {
+	a, err := parseTrust("*")
+	if err != nil || len(a) != 2 {
+		t.Fatalf("parseTrust(*) = %v, %v", a, err)
+	}
+	if _, err := parseTrust("10.0.0.0/8,bogus"); err == nil {
+		t.Error("parseTrust(bogus) = nil error")
+	}
+}
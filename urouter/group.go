@@ -3,36 +3,97 @@ package main
 import (
 	"encoding/json"
 	"io"
-	"math/rand"
 	"net/http"
 	"sync"
+	"time"
 )
 
 type Group struct {
+	name     string
+	balancer Balancer
 	routable []*Backend
+	ejected  []*Backend // taken out of routable; see Eject
+	failing  []*Backend // ejected for errors, not draining
 	backends []*Backend
+	budget   budget
 	mu       sync.RWMutex
 }
 
 func (g *Group) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if e := logEntryFrom(r); e != nil {
+		e.App = g.name
+	}
+	appInFlight.add(1, g.name)
+	defer appInFlight.add(-1, g.name)
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	defer func() {
+		appRequests.add(1, g.name, statusLabel(sw))
+		if !sw.hijacked {
+			appLatency.observe(since(start), g.name)
+		}
+	}()
+	w = sw
+	g.budget.deposit(retryBudget)
+	if canRetry(r) {
+		g.serveRetry(w, r)
+		return
+	}
 	if b := g.route(r); b != nil {
 		b.ServeHTTP(w, r)
 	} else {
+		if e := logEntryFrom(r); e != nil {
+			e.Err = "no backends"
+		}
 		w.WriteHeader(503)
 		io.WriteString(w, "no backends")
 	}
 }
 
 // route chooses a single Backend in g for r.
-// If there are no routable backends, route returns nil.
+// If every backend has been ejected for errors or failed
+// health checks, route picks one of those anyway: a partial
+// failure shouldn't become "no backends" for the whole app.
+// It skips backends whose connections are full, since a
+// request sent to one would wait for a stream to free up.
+// If there are no backends to pick, route returns nil.
 func (g *Group) route(r *http.Request) *Backend {
+	return g.reroute(r, nil)
+}
+
+// reroute is like route, but it doesn't choose
+// any of the backends in tried.
+func (g *Group) reroute(r *http.Request, tried []*Backend) *Backend {
 	g.mu.RLock()
 	defer g.mu.RUnlock()
-	if len(g.routable) == 0 {
+	a := g.routable
+	if len(a) == 0 {
+		a = g.failing
+	}
+	all := a
+	a = nil
+	for _, b := range all {
+		if !backendsContain(tried, b) && !b.full() {
+			a = append(a, b)
+		}
+	}
+	if len(a) == 0 {
 		return nil
 	}
-	// TODO(kr): do something smarter than rand
-	return g.routable[rand.Intn(len(g.routable))]
+	bal := g.balancer
+	if bal == nil {
+		bal = newBalancer(defBalancer)
+	}
+	return bal.Pick(a)
+}
+
+func backendsContain(a []*Backend, b *Backend) bool {
+	for _, t := range a {
+		if t == b {
+			return true
+		}
+	}
+	return false
 }
 
 func (g *Group) Add(b *Backend) {
@@ -52,6 +113,36 @@ func (g *Group) Remove(b *Backend) {
 	defer g.mu.Unlock()
 	g.backends = backendsRemove(g.backends, b)
 	g.routable = backendsRemove(g.routable, b)
+	g.ejected = backendsRemove(g.ejected, b)
+	g.failing = backendsRemove(g.failing, b)
+}
+
+// Eject takes b out of the routable backends in g
+// until a subsequent call to Restore. If failing is set,
+// b is being ejected for errors, and route may still
+// pick it when nothing else is left; otherwise, as for
+// a draining backend, it won't.
+func (g *Group) Eject(b *Backend, failing bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.routable = backendsRemove(g.routable, b)
+	g.ejected = append(backendsRemove(g.ejected, b), b)
+	g.failing = backendsRemove(g.failing, b)
+	if failing {
+		g.failing = append(g.failing, b)
+	}
+}
+
+// Restore makes b routable again if it was ejected from g.
+func (g *Group) Restore(b *Backend) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := len(g.ejected)
+	g.ejected = backendsRemove(g.ejected, b)
+	g.failing = backendsRemove(g.failing, b)
+	if len(g.ejected) < n {
+		g.routable = append(g.routable, b)
+	}
 }
 
 // backendsRemove destructively removes elements of a that
@@ -70,3 +70,80 @@ func TestGroupEmptyResp(t *testing.T) {
 		t.Errorf("code = %d want 503", w.code)
 	}
 }
+
+func TestGroupEjectRestore(t *testing.T) {
+	b := NewBackend(nil)
+	g := &Group{backends: []*Backend{b}, routable: []*Backend{b}}
+	g.Eject(b, false)
+	if n := len(g.routable); n != 0 {
+		t.Fatalf("len(g.routable) = %d want 0", n)
+	}
+	g.Restore(b)
+	if n := len(g.routable); n != 1 {
+		t.Fatalf("len(g.routable) = %d want 1", n)
+	}
+	g.Restore(b)
+	if n := len(g.routable); n != 1 {
+		t.Fatalf("len(g.routable) = %d want 1 after second restore", n)
+	}
+
+	g.Eject(b, false)
+	g.Remove(b)
+	g.Restore(b)
+	if n := len(g.routable); n != 0 {
+		t.Errorf("len(g.routable) = %d want 0 after remove", n)
+	}
+}
+
+func TestGroupRouteFailing(t *testing.T) {
+	b1, b2 := NewBackend(nil), NewBackend(nil)
+	g := new(Group)
+	b1.addRoute(g)
+	b2.addRoute(g)
+	b1.setDown(downOutlier)
+	if b := g.route(nil); b != b2 {
+		t.Fatalf("route = %v want b2", b)
+	}
+	b2.setDown(downHealth)
+	if n := len(g.routable); n != 0 {
+		t.Fatalf("len(g.routable) = %d want 0", n)
+	}
+	if b := g.route(nil); b != b1 && b != b2 {
+		t.Fatalf("route = %v want an ejected backend", b)
+	}
+	if b := g.reroute(nil, []*Backend{b1}); b != b2 {
+		t.Errorf("reroute = %v want b2", b)
+	}
+
+	// draining backends are never picked
+	b2.setDown(downDrain)
+	if b := g.route(nil); b != b1 {
+		t.Errorf("route = %v want b1", b)
+	}
+	b1.setDown(downDrain)
+	if b := g.route(nil); b != nil {
+		t.Errorf("route = %v want nil", b)
+	}
+}
+
+// fullTransport is a transport whose connection
+// has no streams free.
+type fullTransport struct{ http.RoundTripper }
+
+func (fullTransport) CanTakeNewRequest() bool { return false }
+
+func TestGroupRouteFull(t *testing.T) {
+	b1, b2 := NewBackend(nil), newBackend(nil, fullTransport{})
+	g := new(Group)
+	b1.addRoute(g)
+	b2.addRoute(g)
+	for i := 0; i < 10; i++ {
+		if b := g.route(nil); b != b1 {
+			t.Fatalf("route = %v want b1", b)
+		}
+	}
+	b1.setDown(downDrain)
+	if b := g.route(nil); b != nil {
+		t.Errorf("route = %v want nil", b)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/kr/webx"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTP2Trailers(t *testing.T) {
+	defer func(w io.Writer) { accessLogOut = w }(accessLogOut)
+	accessLogOut = ioutil.Discard
+
+	lb := newRH2Loopback(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Checksum, X-Echo")
+		w.Write([]byte("part1"))
+		w.(http.Flusher).Flush()
+		w.Write(body)
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set("X-Echo", r.Trailer.Get("X-Req"))
+	}))
+	defer lb.Close()
+
+	front := httptest.NewUnstartedServer(idHandler(accessLogHandler(lb.d, nil)))
+	front.EnableHTTP2 = true
+	front.StartTLS()
+	defer front.Close()
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("POST", front.URL+"/", pr)
+	req.Host = "foo." + webx.AppDomain
+	req.Trailer = http.Header{"X-Req": nil}
+	go func() {
+		io.WriteString(pw, "part2")
+		req.Trailer.Set("X-Req", "t1")
+		pw.Close()
+	}()
+	resp, err := front.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("proto = %s want HTTP/2", resp.Proto)
+	}
+	got, _ := ioutil.ReadAll(resp.Body)
+	if string(got) != "part1part2" {
+		t.Errorf("body = %q want part1part2", got)
+	}
+	if g := resp.Trailer.Get("X-Checksum"); g != "abc" {
+		t.Errorf("trailer X-Checksum = %q want abc", g)
+	}
+	if g := resp.Trailer.Get("X-Echo"); g != "t1" {
+		t.Errorf("request trailer = %q want t1", g)
+	}
+}
+
+func TestRSPDYTrailers(t *testing.T) {
+	b := NewBackend(nil)
+	b.proxy.Transport = funcTransport(func(*http.Request) (*http.Response, error) {
+		t.Error("request with trailers sent over rspdy")
+		return nil, io.EOF
+	})
+	r, _ := http.NewRequest("POST", "http://foo."+webx.AppDomain+"/", nil)
+	r.Trailer = http.Header{"X-Req": nil}
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, r)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("status = %d want %d", w.Code, http.StatusNotImplemented)
+	}
+	if b.errs != 0 {
+		t.Errorf("errs = %d want 0", b.errs)
+	}
+}
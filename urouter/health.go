@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"github.com/kr/webx"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	defHealthInterval = 10 * time.Second // HEALTHINTERVAL
+	defHealthTimeout  = 5 * time.Second  // HEALTHTIMEOUT
+
+	healthFall = 2 // consecutive failed probes before ejecting
+	healthRise = 2 // consecutive good probes before restoring
+)
+
+var (
+	healthInterval = defHealthInterval
+	healthTimeout  = defHealthTimeout
+)
+
+// checkHealth probes b periodically until done is closed.
+// It ejects b from its groups after healthFall consecutive
+// failures and restores it after healthRise successes.
+func (b *Backend) checkHealth(done <-chan bool) {
+	t := time.NewTicker(healthInterval)
+	defer t.Stop()
+	var fails, oks int
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		if b.probe() {
+			fails = 0
+			if oks++; oks == healthRise {
+				b.setUp(downHealth)
+			}
+		} else {
+			oks = 0
+			if fails++; fails == healthFall {
+				b.setDown(downHealth)
+			}
+		}
+	}
+}
+
+// probe reports whether b answers a health check request
+// within healthTimeout. The webx client passes the request
+// on to the app, so a hung app times out and one that has
+// crashed behind webxd gets a 502. Apps that don't
+// implement the health endpoint usually answer 404; that's
+// good enough to show they aren't wedged. A 5xx status, a
+// transport error, or a timeout, even partway through the
+// body, counts as failure.
+func (b *Backend) probe() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", "https://"+webx.BackendHost+webx.HealthPath, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return false
+	}
+	return resp.StatusCode < 500
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type funcTransport func(*http.Request) (*http.Response, error)
+
+func (f funcTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func statusTransport(code int) http.RoundTripper {
+	return funcTransport(func(r *http.Request) (*http.Response, error) {
+		resp := &http.Response{
+			StatusCode: code,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    r,
+		}
+		return resp, nil
+	})
+}
+
+func TestProbe(t *testing.T) {
+	var cases = []struct {
+		rt http.RoundTripper
+		w  bool
+	}{
+		{statusTransport(200), true},
+		{statusTransport(404), true},
+		{statusTransport(503), false},
+		{funcTransport(func(*http.Request) (*http.Response, error) {
+			return nil, errors.New("broken")
+		}), false},
+		{funcTransport(func(r *http.Request) (*http.Response, error) {
+			<-r.Context().Done() // a hung app
+			return nil, r.Context().Err()
+		}), false},
+	}
+	defer func(d time.Duration) { healthTimeout = d }(healthTimeout)
+	healthTimeout = 10 * time.Millisecond
+	for i, test := range cases {
+		b := NewBackend(nil)
+		b.client.Transport = test.rt
+		if g := b.probe(); g != test.w {
+			t.Errorf("%d: probe() = %v want %v", i, g, test.w)
+		}
+	}
+}
+
+func TestBackendDownUp(t *testing.T) {
+	b := NewBackend(nil)
+	g := new(Group)
+	b.addRoute(g)
+	if n := len(g.routable); n != 1 {
+		t.Fatalf("len(g.routable) = %d want 1", n)
+	}
+	b.setDown(downHealth)
+	if n := len(g.routable); n != 0 {
+		t.Fatalf("len(g.routable) = %d want 0", n)
+	}
+
+	// groups added while b is down start out ejected
+	h := new(Group)
+	b.addRoute(h)
+	if n := len(h.routable); n != 0 {
+		t.Fatalf("len(h.routable) = %d want 0", n)
+	}
+
+	b.setUp(downHealth)
+	if n := len(g.routable); n != 1 {
+		t.Errorf("len(g.routable) = %d want 1", n)
+	}
+	if n := len(h.routable); n != 1 {
+		t.Errorf("len(h.routable) = %d want 1", n)
+	}
+}
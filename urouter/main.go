@@ -6,15 +6,22 @@ import (
 	"encoding/base32"
 	"github.com/fernet/fernet-go"
 	"github.com/kr/spdy"
+	"github.com/kr/webx"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 const (
-	defRequestAddr    = ":8000" // REQADDR
-	defRequestTLSAddr = ":4443" // REQTLSADDR
+	defRequestAddr    = ":8000" // REQADDR; PROXY protocol: REQPROXY
+	defRequestTLSAddr = ":4443" // REQTLSADDR; PROXY protocol: REQTLSPROXY
 	defBackendAddr    = ":1111" // BKDADDR
 
 	innerCertFile = "inner.crt"
@@ -25,6 +32,9 @@ const (
 
 var (
 	fernetKeys []*fernet.Key // FERNET_KEY
+	balancers  balancerTable // BALANCE
+	domainFile string        // DOMAINFILE
+	drainFile  string        // DRAINFILE
 )
 
 func main() {
@@ -35,35 +45,104 @@ func main() {
 	if err != nil {
 		log.Fatal("FERNET_KEY contains invalid keys: ", err)
 	}
+	accessLogFormat = os.Getenv("ACCESSLOG")
+	switch accessLogFormat {
+	case "":
+		accessLogFormat = defAccessLogFormat
+	case "json", "logfmt", "off":
+	default:
+		log.Fatal("ACCESSLOG must be json, logfmt, or off")
+	}
+	balancers, err = parseBalancers(os.Getenv("BALANCE"))
+	if err != nil {
+		log.Fatal("BALANCE: ", err)
+	}
+	healthInterval = durationEnv("HEALTHINTERVAL", defHealthInterval)
+	healthTimeout = durationEnv("HEALTHTIMEOUT", defHealthTimeout)
+	outlierErrors = intEnv("OUTLIERERRORS", defOutlierErrors)
+	outlierBackoff = durationEnv("OUTLIERBACKOFF", defOutlierBackoff)
+	retries = intEnv("RETRIES", defRetries)
+	retryBudget = floatEnv("RETRYBUDGET", defRetryBudget)
+	drainTimeout = durationEnv("DRAINTIMEOUT", defDrainTimeout)
+
+	tracer = newTracer()
+	trustForward, err = parseTrust(os.Getenv("TRUSTFORWARD"))
+	if err != nil {
+		log.Fatal("TRUSTFORWARD: ", err)
+	}
 
+	domainFile = os.Getenv("DOMAINFILE")
 	d := &Directory{tab: make(map[string]*Group)}
+	if err := d.loadDomains(); err != nil {
+		log.Fatal("DOMAINFILE: ", err)
+	}
+	drainFile = os.Getenv("DRAINFILE")
+	if err := d.loadDrains(); err != nil {
+		log.Fatal("DRAINFILE: ", err)
+	}
 	go listenBackends(d)
-	h := idHandler(d)
-	go listenHTTP(h)
-	go listenHTTPS(h)
-	select {}
+	go listenAdmin(d)
+	h := forwardHandler(idHandler(accessLogHandler(traceHandler(d), d.drainLog)))
+	m := newACMEManager(d)
+	certs := &certStore{
+		certFile: outerCertFile,
+		keyFile:  outerKeyFile,
+		dir:      os.Getenv("CERTDIR"),
+		acme:     m,
+	}
+	if err := certs.load(); err != nil {
+		log.Fatal("load certs: ", err)
+	}
+	go certs.reloadOnHangup()
+	go listenHTTP(h, m)
+	go listenHTTPS(h, certs)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	<-sig
+	if err := tracer.Close(); err != nil {
+		log.Println("error: export spans:", err)
+	}
 }
 
-func listenHTTP(handler http.Handler) {
+func listenHTTP(handler http.Handler, m *autocert.Manager) {
 	addr := os.Getenv("REQADDR")
 	if addr == "" {
 		addr = defRequestAddr
 	}
+	if m != nil {
+		handler = m.HTTPHandler(handler) // http-01 challenges
+	}
 	log.Println("listen requests", addr)
-	err := http.ListenAndServe(addr, handler)
+	l, err := listen(addr, proxyMode("REQPROXY"))
+	if err == nil {
+		err = http.Serve(l, handler)
+	}
 	if err != nil {
 		log.Fatal("error: frontend ListenAndServe:", err)
 	}
 	panic("unreached")
 }
 
-func listenHTTPS(handler http.Handler) {
+func listenHTTPS(handler http.Handler, certs *certStore) {
 	addr := os.Getenv("REQTLSADDR")
 	if addr == "" {
 		addr = defRequestTLSAddr
 	}
 	log.Println("listen requests tls", addr)
-	err := http.ListenAndServeTLS(addr, outerCertFile, outerKeyFile, handler)
+	srv := &http.Server{Addr: addr, Handler: handler}
+	srv.TLSConfig = &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if certs.acme != nil {
+		// tls-alpn-01 challenges
+		srv.TLSConfig.NextProtos = append(srv.TLSConfig.NextProtos, acme.ALPNProto)
+	}
+	l, err := listen(addr, proxyMode("REQTLSPROXY"))
+	if err == nil {
+		err = srv.ServeTLS(l, "", "")
+	}
 	if err != nil {
 		log.Fatal("error: frontend ListenAndServeTLS:", err)
 	}
@@ -78,13 +157,16 @@ func listenBackends(dir *Directory) {
 	}
 	log.Println("listen backends", srv.Addr)
 	mux := http.NewServeMux()
-	mux.HandleFunc("api.webx.io/mon/", dir.Monitor)
+	mux.HandleFunc(webx.APIHost+"/mon/", dir.Monitor)
+	mux.HandleFunc(webx.APIHost+"/domains", dir.Domains)
+	mux.HandleFunc(webx.APIHost+"/drain", dir.Drain)
 	srv.Handler = mux
 	srv.TLSConfig = &tls.Config{
-		NextProtos: []string{"spdy/3", "rspdy/3", "http/1.1"},
+		NextProtos: []string{rh2Proto, "spdy/3", "rspdy/3", "http/1.1"},
 	}
 	srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
 		"rspdy/3": dir.ServeRSPDY,
+		rh2Proto:  dir.ServeRH2,
 	}
 	err := srv.ListenAndServeTLS(innerCertFile, innerKeyFile)
 	if err != nil {
@@ -100,6 +182,48 @@ func mustGetenv(key string) string {
 	return val
 }
 
+// durationEnv returns the duration in env key,
+// or def if key is unset.
+func durationEnv(key string, def time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		log.Fatalf("env %s: %v", key, err)
+	}
+	return d
+}
+
+// intEnv returns the integer in env key,
+// or def if key is unset.
+func intEnv(key string, def int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		log.Fatalf("env %s: %v", key, err)
+	}
+	return n
+}
+
+// floatEnv returns the number in env key,
+// or def if key is unset.
+func floatEnv(key string, def float64) float64 {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		log.Fatalf("env %s: %v", key, err)
+	}
+	return f
+}
+
 // idHandler ensures each incoming request has a request ID
 // in header field ID. If the field is already present, it is
 // left alone; otherwise, idHandler generates a new random
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defAdminAddr = "127.0.0.1:8001" // ADMINADDR
+
+// Latency buckets, in seconds.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+var (
+	appRequests = newMetric("counter", "webx_app_requests_total",
+		"Requests served, by app and status code.", "app", "code")
+	appLatency = newHistogram("webx_app_request_duration_seconds",
+		"Time to serve a request, by app.", latencyBuckets, "app")
+	appInFlight = newMetric("gauge", "webx_app_requests_in_flight",
+		"Requests being served, by app.", "app")
+
+	backendRequests = newMetric("counter", "webx_backend_requests_total",
+		"Requests sent to a backend, by backend and status code.", "backend", "code")
+	backendLatency = newHistogram("webx_backend_request_duration_seconds",
+		"Time for a backend to serve a request.", latencyBuckets, "backend")
+	backendInFlight = newMetric("gauge", "webx_backend_requests_in_flight",
+		"Requests outstanding at a backend.", "backend")
+
+	groupBackends = newMetric("gauge", "webx_group_backends",
+		"Backends in an app's group, by state.", "app", "state")
+	backendConns = newMetric("gauge", "webx_backend_connections",
+		"Connected backends.")
+	handshakeFailures = newMetric("counter", "webx_handshake_failures_total",
+		"Backend connections that failed the names handshake.", "reason")
+	websocketSessions = newMetric("gauge", "webx_websocket_sessions",
+		"Open websocket sessions.")
+	websocketTotal = newMetric("counter", "webx_websocket_sessions_total",
+		"Websocket sessions started.")
+)
+
+var metrics = []*metric{
+	appRequests,
+	appLatency,
+	appInFlight,
+	backendRequests,
+	backendLatency,
+	backendInFlight,
+	groupBackends,
+	backendConns,
+	handshakeFailures,
+	websocketSessions,
+	websocketTotal,
+}
+
+// A metric is a family of time series in the
+// Prometheus text exposition format, one series
+// for each distinct set of label values.
+type metric struct {
+	kind    string // "counter", "gauge", or "histogram"
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // upper bounds, for histograms
+
+	mu     sync.Mutex
+	series map[string]*series // key is formatted labels
+}
+
+type series struct {
+	labels []string // values, in the order of metric.labels
+	val    float64  // counter or gauge value; histogram sum
+	counts []uint64 // per bucket, for histograms
+	n      uint64   // observations, for histograms
+}
+
+func newMetric(kind, name, help string, labels ...string) *metric {
+	return &metric{
+		kind:   kind,
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	m := newMetric("histogram", name, help, labels...)
+	m.buckets = buckets
+	return m
+}
+
+// get returns the series for label values lv,
+// creating it if necessary. Caller holds m.mu.
+func (m *metric) get(lv []string) *series {
+	if len(lv) != len(m.labels) {
+		panic("metric " + m.name + ": wrong number of labels")
+	}
+	k := m.key(lv)
+	s := m.series[k]
+	if s == nil {
+		s = &series{labels: lv, counts: make([]uint64, len(m.buckets))}
+		m.series[k] = s
+	}
+	return s
+}
+
+func (m *metric) key(lv []string) string {
+	var a []string
+	for i, l := range m.labels {
+		a = append(a, l+"="+quoteLabel(lv[i]))
+	}
+	return strings.Join(a, ",")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel quotes a label value as the text format
+// requires: only backslash, double quote, and newline
+// are escaped. Other bytes, even invalid UTF-8, pass
+// through as they are.
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+// add adds v to the series for lv.
+func (m *metric) add(v float64, lv ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(lv).val += v
+}
+
+// set sets the series for lv to v.
+func (m *metric) set(v float64, lv ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(lv).val = v
+}
+
+// observe records v in the histogram series for lv.
+func (m *metric) observe(v float64, lv ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(lv)
+	for i, le := range m.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.n++
+	s.val += v
+}
+
+// forget removes every series whose label named l has
+// value v, so that short-lived label values, like
+// backend addresses, don't accumulate forever.
+func (m *metric) forget(l, v string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, name := range m.labels {
+		if name != l {
+			continue
+		}
+		for k, s := range m.series {
+			if s.labels[i] == v {
+				delete(m.series, k)
+			}
+		}
+	}
+}
+
+// reset removes all series from m.
+func (m *metric) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.series = make(map[string]*series)
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	if len(m.series) == 0 && len(m.labels) == 0 {
+		fmt.Fprintf(w, "%s 0\n", m.name)
+		return
+	}
+	var keys []string
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, braces(k), formatFloat(s.val))
+			continue
+		}
+		for i, le := range m.buckets {
+			lk := joinLabels(k, "le="+quoteLabel(formatFloat(le)))
+			fmt.Fprintf(w, "%s_bucket{%s} %d\n", m.name, lk, s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s} %d\n", m.name, joinLabels(k, `le="+Inf"`), s.n)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, braces(k), formatFloat(s.val))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, braces(k), s.n)
+	}
+}
+
+func braces(k string) string {
+	if k == "" {
+		return ""
+	}
+	return "{" + k + "}"
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Metrics serves all metrics in the Prometheus
+// text format.
+func (d *Directory) Metrics(w http.ResponseWriter, r *http.Request) {
+	d.updateGroupMetrics()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	bw.Flush()
+}
+
+// updateGroupMetrics sets the group size gauges
+// from the current state of d.
+func (d *Directory) updateGroupMetrics() {
+	d.mu.RLock()
+	groups := make([]*Group, 0, len(d.tab))
+	for _, g := range d.tab {
+		groups = append(groups, g)
+	}
+	d.mu.RUnlock()
+	groupBackends.reset()
+	for _, g := range groups {
+		g.mu.RLock()
+		n := len(g.backends)
+		routable := len(g.routable)
+		ejected := len(g.ejected)
+		g.mu.RUnlock()
+		groupBackends.set(float64(routable), g.name, "routable")
+		groupBackends.set(float64(ejected), g.name, "ejected")
+		groupBackends.set(float64(n-routable-ejected), g.name, "monitor")
+	}
+}
+
+// statusLabel returns the code label for a request
+// written to sw: the status code, "hijacked" if the
+// connection was taken over, as for a websocket, or
+// "error" if nothing was written, as for a failed try
+// that will be retried.
+func statusLabel(sw *statusWriter) string {
+	switch {
+	case sw.hijacked:
+		return "hijacked"
+	case sw.code == 0:
+		return "error"
+	}
+	return strconv.Itoa(sw.code)
+}
+
+// forgetBackend removes the series for a backend
+// that has gone away.
+func forgetBackend(label string) {
+	for _, m := range []*metric{backendRequests, backendLatency, backendInFlight} {
+		m.forget("backend", label)
+	}
+}
+
+// retire notes that b's connection has ended. Requests
+// may still be in flight on it, and each one updates b's
+// series as it finishes, so the series are removed only
+// when the last of them is done; see finish.
+func (b *Backend) retire() {
+	atomic.StoreInt32(&b.retired, 1)
+	if b.Outstanding() == 0 {
+		forgetBackend(b.String())
+	}
+}
+
+// finish ends a request on b. It must be called after
+// the request's metrics are recorded.
+func (b *Backend) finish(label string) {
+	if atomic.AddInt64(&b.outstanding, -1) == 0 && atomic.LoadInt32(&b.retired) != 0 {
+		forgetBackend(label)
+	}
+}
+
+func since(t time.Time) float64 {
+	return time.Since(t).Seconds()
+}
+
+// listenAdmin serves the metrics on the admin listener.
+func listenAdmin(dir *Directory) {
+	addr := os.Getenv("ADMINADDR")
+	if addr == "" {
+		addr = defAdminAddr
+	}
+	if addr == "off" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", dir.Metrics)
+	log.Println("listen admin", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		log.Fatal("error: admin ListenAndServe:", err)
+	}
+}
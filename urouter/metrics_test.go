@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestMetricWrite(t *testing.T) {
+	m := newHistogram("h", "A histogram.", []float64{1, 2}, "app")
+	m.observe(0.5, "foo")
+	m.observe(1.5, "foo")
+	m.observe(3, "foo")
+	var buf bytes.Buffer
+	m.write(&buf)
+	want := `# HELP h A histogram.
+# TYPE h histogram
+h_bucket{app="foo",le="1"} 1
+h_bucket{app="foo",le="2"} 2
+h_bucket{app="foo",le="+Inf"} 3
+h_sum{app="foo"} 5
+h_count{app="foo"} 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMetricForget(t *testing.T) {
+	m := newMetric("counter", "c", "A counter.", "backend", "code")
+	m.add(1, "a", "200")
+	m.add(1, "a", "502")
+	m.add(1, "b", "200")
+	m.forget("backend", "a")
+	var buf bytes.Buffer
+	m.write(&buf)
+	if s := buf.String(); strings.Contains(s, `"a"`) || !strings.Contains(s, `c{backend="b",code="200"} 1`) {
+		t.Errorf("after forget:\n%s", s)
+	}
+}
+
+func TestGroupMetrics(t *testing.T) {
+	defer appRequests.reset()
+	g := &Group{name: "metricsapp"}
+	r, _ := http.NewRequest("POST", "http://metricsapp.webxapp.io/", nil)
+	g.ServeHTTP(new(resp), r)
+
+	d := &Directory{tab: map[string]*Group{"metricsapp": g}}
+	g.Add(NewBackend(nil))
+	w := new(resp)
+	d.Metrics(w, r)
+	for _, want := range []string{
+		`webx_app_requests_total{app="metricsapp",code="503"} 1`,
+		`webx_group_backends{app="metricsapp",state="monitor"} 1`,
+		`webx_app_requests_in_flight{app="metricsapp"} 0`,
+	} {
+		if !strings.Contains(string(w.body), want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
+
+func TestQuoteLabel(t *testing.T) {
+	var cases = []struct {
+		s, w string
+	}{
+		{"foo", `"foo"`},
+		{`a\b"c` + "\n", `"a\\b\"c\n"`},
+		{"tab\tü\x01", "\"tab\tü\x01\""},
+	}
+	for _, test := range cases {
+		if g := quoteLabel(test.s); g != test.w {
+			t.Errorf("quoteLabel(%q) = %s want %s", test.s, g, test.w)
+		}
+	}
+}
+
+func TestRetireInFlight(t *testing.T) {
+	release := make(chan bool)
+	b := newBackend(nil, funcTransport(func(r *http.Request) (*http.Response, error) {
+		<-release
+		return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+	}))
+	b.proxy.Transport = b.client.Transport
+	done := make(chan bool)
+	go func() {
+		r, _ := http.NewRequest("GET", "http://foo.webxapp.io/", nil)
+		b.ServeHTTP(new(resp), r)
+		close(done)
+	}()
+	for b.Outstanding() == 0 {
+		runtime.Gosched()
+	}
+	b.retire()
+	close(release)
+	<-done
+	for _, m := range []*metric{backendRequests, backendLatency, backendInFlight} {
+		var buf bytes.Buffer
+		m.write(&buf)
+		if s := buf.String(); strings.Contains(s, `backend="backend"`) {
+			t.Errorf("after retire:\n%s", s)
+		}
+	}
+}
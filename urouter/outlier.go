@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defOutlierErrors  = 5                // OUTLIERERRORS
+	defOutlierBackoff = 30 * time.Second // OUTLIERBACKOFF
+)
+
+var (
+	outlierErrors  = defOutlierErrors
+	outlierBackoff = defOutlierBackoff
+
+	afterFunc = time.AfterFunc // replaced in tests
+)
+
+// record notes the status code of a response from b.
+// Transport errors show up here as 502 from the proxy.
+// After outlierErrors consecutive 5xx responses, record
+// ejects b from its groups for outlierBackoff. Setting
+// outlierErrors to 0 turns this off. If every backend in a
+// group is ejected, the group still routes to them; see
+// Group.route.
+func (b *Backend) record(code int) {
+	if code < 500 {
+		atomic.StoreInt32(&b.errs, 0)
+		return
+	}
+	if outlierErrors <= 0 {
+		return
+	}
+	if atomic.AddInt32(&b.errs, 1) == int32(outlierErrors) {
+		b.setDown(downOutlier)
+		afterFunc(outlierBackoff, func() {
+			atomic.StoreInt32(&b.errs, 0)
+			b.setUp(downOutlier)
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutlierEject(t *testing.T) {
+	defer func(n int, d time.Duration) {
+		outlierErrors, outlierBackoff = n, d
+	}(outlierErrors, outlierBackoff)
+	outlierErrors, outlierBackoff = 3, time.Minute
+	defer func(f func(time.Duration, func()) *time.Timer) { afterFunc = f }(afterFunc)
+	restore := make(chan func(), 1)
+	afterFunc = func(d time.Duration, f func()) *time.Timer {
+		if d != outlierBackoff {
+			t.Errorf("backoff = %v want %v", d, outlierBackoff)
+		}
+		restore <- f
+		return nil
+	}
+
+	b := NewBackend(nil)
+	g := new(Group)
+	b.addRoute(g)
+	b.record(500)
+	b.record(502)
+	b.record(200) // resets the count
+	b.record(500)
+	b.record(500)
+	if n := len(g.routable); n != 1 {
+		t.Fatalf("len(g.routable) = %d want 1", n)
+	}
+	b.record(503)
+	if n := len(g.routable); n != 0 {
+		t.Fatalf("len(g.routable) = %d want 0", n)
+	}
+
+	(<-restore)() // the backoff has passed
+	if n := len(g.routable); n != 1 {
+		t.Errorf("len(g.routable) = %d want 1 after backoff", n)
+	}
+}
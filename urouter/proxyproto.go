@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol modes for a listener, from REQPROXY
+// and REQTLSPROXY.
+//
+// In optional mode, any client that reaches the listener
+// directly can send its own header and claim any address.
+// It is safe only when every connection comes through a
+// load balancer that always sends its own header ahead
+// of the client's bytes, and the listener can't be
+// reached any other way. It's meant for switching a
+// balancer over to the PROXY protocol; use on after that.
+const (
+	proxyOff      = "off"      // no PROXY header expected
+	proxyOn       = "on"       // every connection must send one
+	proxyOptional = "optional" // use the header if it's there
+)
+
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("bad PROXY protocol header")
+
+// proxyListener reads a PROXY protocol (v1 or v2) header
+// at the start of each connection it accepts, as sent by
+// a TCP load balancer, and reports the client address it
+// names as the connection's RemoteAddr.
+type proxyListener struct {
+	net.Listener
+	optional bool // allow connections with no header
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{
+		Conn:     c,
+		br:       bufio.NewReader(c),
+		optional: l.optional,
+	}, nil
+}
+
+// proxyConn reads the PROXY header lazily, on the first
+// call to Read or RemoteAddr, so a slow client doesn't
+// hold up the accept loop.
+type proxyConn struct {
+	net.Conn
+	br       *bufio.Reader
+	optional bool
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.br, c.optional)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol header from r
+// and returns the source address in it. It returns a nil
+// address for a header that carries no address, such as
+// a v2 LOCAL command or v1 UNKNOWN, and, if optional is
+// set, for a connection with no header.
+func readProxyHeader(r *bufio.Reader, optional bool) (net.Addr, error) {
+	p, err := r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case string(p) == "PROXY":
+		return readProxyV1(r)
+	case bytes.Equal(p, proxyV2Sig[:5]):
+		return readProxyV2(r)
+	case optional:
+		return nil, nil
+	}
+	return nil, errProxyHeader
+}
+
+// readProxyV1 reads a header like
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 { // the longest valid header
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s := string(line)
+	if !strings.HasSuffix(s, "\r\n") {
+		return nil, errProxyHeader
+	}
+	f := strings.Split(strings.TrimSuffix(s, "\r\n"), " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || f[1] != "TCP4" && f[1] != "TCP6" {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (f[1] == "TCP4") {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var h [16]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(h[:12], proxyV2Sig) || h[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch h[12] & 0xf {
+	case 0: // LOCAL, e.g. the balancer's own health check
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errProxyHeader
+	}
+	var n int
+	switch h[13] {
+	case 0x11: // TCP over IPv4
+		n = 4
+	case 0x21: // TCP over IPv6
+		n = 16
+	default: // UDP, unix sockets, or unspecified
+		return nil, nil
+	}
+	if len(body) < 2*n+4 {
+		return nil, errProxyHeader
+	}
+	ip := net.IP(append([]byte(nil), body[:n]...))
+	port := binary.BigEndian.Uint16(body[2*n:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// proxyMode returns the PROXY protocol mode in env key.
+func proxyMode(key string) string {
+	switch s := os.Getenv(key); s {
+	case "":
+		return proxyOff
+	case proxyOff, proxyOn:
+		return s
+	case proxyOptional:
+		log.Printf("warning: %s=optional trusts PROXY headers from any client", key)
+		return s
+	}
+	log.Fatalf("env %s must be off, on, or optional", key)
+	panic("unreached")
+}
+
+// listen listens on addr, reading PROXY headers
+// according to mode.
+func listen(addr, mode string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if mode == proxyOff {
+		return l, nil
+	}
+	return &proxyListener{Listener: l, optional: mode == proxyOptional}, nil
+}
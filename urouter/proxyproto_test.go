@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func proxyV2(cmd, fam byte, addrs []byte) []byte {
+	b := append([]byte(nil), proxyV2Sig...)
+	b = append(b, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(v6[32:], 56324)
+	cases := []struct {
+		in       string
+		optional bool
+		want     string // "" for no address
+		wantErr  bool
+	}{
+		{in: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nGET /", want: "192.0.2.1:56324"},
+		{in: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET /", want: "[2001:db8::1]:56324"},
+		{in: "PROXY UNKNOWN\r\nGET /"},
+		{in: "PROXY TCP4 2001:db8::1 192.0.2.2 56324 443\r\n", wantErr: true},
+		{in: "PROXY TCP4 192.0.2.1\r\n", wantErr: true},
+		{in: "PROXY " + strings.Repeat("x", 200), wantErr: true},
+		{in: string(proxyV2(1, 0x11, v4)) + "GET /", want: "192.0.2.1:56324"},
+		{in: string(proxyV2(1, 0x21, v6)) + "GET /", want: "[2001:db8::1]:56324"},
+		{in: string(proxyV2(0, 0x00, nil)) + "GET /"},
+		{in: string(proxyV2(1, 0x11, v4[:4])), wantErr: true},
+		{in: "GET / HTTP/1.1\r\n", wantErr: true},
+		{in: "GET / HTTP/1.1\r\n", optional: true},
+	}
+	for _, c := range cases {
+		r := bufio.NewReader(strings.NewReader(c.in))
+		addr, err := readProxyHeader(r, c.optional)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("readProxyHeader(%q) = %v, want error", c.in, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readProxyHeader(%q) error %v", c.in, err)
+			continue
+		}
+		var got string
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != c.want {
+			t.Errorf("readProxyHeader(%q) = %q want %q", c.in, got, c.want)
+		}
+		if rest, _ := ioutil.ReadAll(r); !bytes.HasPrefix(rest, []byte("GET /")) {
+			t.Errorf("readProxyHeader(%q) left %q", c.in, rest)
+		}
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	l, err := listen("127.0.0.1:0", proxyOn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.2 1234 443\r\nhello"))
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if g := c.RemoteAddr().String(); g != "203.0.113.7:1234" {
+		t.Errorf("RemoteAddr = %q want 203.0.113.7:1234", g)
+	}
+	b, _ := ioutil.ReadAll(c)
+	if string(b) != "hello" {
+		t.Errorf("read %q want hello", b)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+)
+
+const (
+	defRetries     = 2   // RETRIES
+	defRetryBudget = 0.2 // RETRYBUDGET
+
+	maxRetryBody = 64 << 10 // largest request body we'll buffer to retry
+	retryBurst   = 10       // retries allowed before the budget kicks in
+)
+
+var (
+	retries     = defRetries
+	retryBudget = defRetryBudget
+)
+
+type attemptKey struct{}
+
+// An attempt records the outcome of one try
+// at proxying a retryable request.
+type attempt struct {
+	err error // set if the transport failed
+}
+
+// canRetry reports whether r can safely be sent to
+// another backend after a transport failure. Only GET,
+// HEAD, and requests that carry an Idempotency-Key header
+// qualify, and only if the body is small enough to buffer
+// and has no trailers.
+func canRetry(r *http.Request) bool {
+	if retries <= 0 || r.Header.Get("Upgrade") != "" || r.Trailer != nil {
+		return false
+	}
+	if r.Method != "GET" && r.Method != "HEAD" && r.Header.Get("Idempotency-Key") == "" {
+		return false
+	}
+	return r.ContentLength >= 0 && r.ContentLength <= maxRetryBody
+}
+
+// serveRetry proxies r to a backend in g, retrying on other
+// backends if the transport fails before a response is sent.
+func (g *Group) serveRetry(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	if r.ContentLength > 0 {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+		if err != nil {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var (
+		tried   []*Backend
+		lastErr error
+	)
+	for {
+		b := g.reroute(r, tried)
+		if b == nil {
+			break
+		}
+		a := new(attempt)
+		ar := r.WithContext(context.WithValue(r.Context(), attemptKey{}, a))
+		if body != nil {
+			ar.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		b.ServeHTTP(w, ar)
+		if a.err == nil {
+			return
+		}
+		log.Println("error: proxy", b, a.err)
+		lastErr = a.err
+		tried = append(tried, b)
+		if len(tried) > retries || r.Context().Err() != nil || !g.budget.withdraw() {
+			break
+		}
+	}
+	e := logEntryFrom(r)
+	if len(tried) == 0 {
+		if e != nil {
+			e.Err = "no backends"
+		}
+		w.WriteHeader(503)
+		io.WriteString(w, "no backends")
+		return
+	}
+	if e != nil {
+		e.Err = lastErr.Error()
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// A budget limits retries to a fraction of requests,
+// so a widespread failure doesn't multiply the load on
+// the remaining backends. The zero value is full.
+type budget struct {
+	mu   sync.Mutex
+	used float64
+}
+
+// deposit credits the budget for one request.
+func (b *budget) deposit(ratio float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used -= ratio; b.used < 0 {
+		b.used = 0
+	}
+}
+
+// withdraw spends one retry. It reports
+// whether there was enough left in the budget.
+func (b *budget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+1 > retryBurst {
+		return false
+	}
+	b.used++
+	return true
+}
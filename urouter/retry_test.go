@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var errBroken = errors.New("broken")
+
+func brokenTransport(*http.Request) (*http.Response, error) {
+	return nil, errBroken
+}
+
+func retryGroup(rts ...http.RoundTripper) *Group {
+	g := &Group{balancer: new(RoundRobin)}
+	for _, rt := range rts {
+		b := NewBackend(nil)
+		b.proxy.Transport = rt
+		g.backends = append(g.backends, b)
+		g.routable = append(g.routable, b)
+	}
+	return g
+}
+
+func TestRetry(t *testing.T) {
+	g := retryGroup(funcTransport(brokenTransport), statusTransport(200))
+	req, _ := http.NewRequest("GET", "http://foo.webxapp.io/", nil)
+	w := new(resp)
+	g.ServeHTTP(w, req)
+	if w.code != 200 {
+		t.Errorf("code = %d want 200", w.code)
+	}
+}
+
+func TestRetryBody(t *testing.T) {
+	var got []string
+	ok := funcTransport(func(r *http.Request) (*http.Response, error) {
+		b := make([]byte, 10)
+		n, _ := r.Body.Read(b)
+		got = append(got, string(b[:n]))
+		return statusTransport(200).RoundTrip(r)
+	})
+	g := retryGroup(funcTransport(func(r *http.Request) (*http.Response, error) {
+		r.Body.Read(make([]byte, 10)) // consume the body, then fail
+		return nil, errBroken
+	}), ok)
+	req, _ := http.NewRequest("POST", "http://foo.webxapp.io/", strings.NewReader("hello"))
+	req.Header.Set("Idempotency-Key", "abc")
+	w := new(resp)
+	g.ServeHTTP(w, req)
+	if w.code != 200 {
+		t.Errorf("code = %d want 200", w.code)
+	}
+	if len(got) != 1 || got[0] != "hello" {
+		t.Errorf("body = %q want [hello]", got)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	g := retryGroup(funcTransport(brokenTransport), funcTransport(brokenTransport))
+	req, _ := http.NewRequest("GET", "http://foo.webxapp.io/", nil)
+	w := new(resp)
+	g.ServeHTTP(w, req)
+	if w.code != 502 {
+		t.Errorf("code = %d want 502", w.code)
+	}
+}
+
+func TestNoRetryPost(t *testing.T) {
+	g := retryGroup(funcTransport(brokenTransport), statusTransport(200))
+	req, _ := http.NewRequest("POST", "http://foo.webxapp.io/", strings.NewReader("hello"))
+	w := new(resp)
+	g.ServeHTTP(w, req)
+	if w.code != 502 {
+		t.Errorf("code = %d want 502", w.code)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	var b budget
+	for i := 0; i < retryBurst; i++ {
+		if !b.withdraw() {
+			t.Fatalf("withdraw %d failed", i)
+		}
+	}
+	if b.withdraw() {
+		t.Fatal("withdraw succeeded on empty budget")
+	}
+	for i := 0; i < 10; i++ {
+		b.deposit(0.2)
+	}
+	if !b.withdraw() {
+		t.Fatal("withdraw failed after deposit")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"golang.org/x/net/http2"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The rh2 protocol is RSPDY over HTTP/2 instead of SPDY/3.
+// The backend dials the router and negotiates "rh2" with
+// ALPN; then the roles reverse, and the router speaks
+// HTTP/2 as the client on the connection, sending requests
+// to the backend, which is the server.
+const rh2Proto = "rh2"
+
+// How long an rh2 connection can be quiet before the router
+// pings it, and how long to wait for the answer. This finds
+// dead backends sooner than the health checks.
+const (
+	rh2ReadIdle    = 30 * time.Second
+	rh2PingTimeout = 15 * time.Second
+)
+
+// ServeRH2 serves an incoming rh2 connection.
+// Like ServeRSPDY, it makes a new backend to represent
+// the conn, then starts the handshake process.
+func (d *Directory) ServeRH2(s *http.Server, c *tls.Conn, h http.Handler) {
+	t := &http2.Transport{
+		ReadIdleTimeout: rh2ReadIdle,
+		PingTimeout:     rh2PingTimeout,
+	}
+	cc, err := t.NewClientConn(c)
+	if err != nil {
+		log.Println("error: rh2 client conn:", err)
+		return
+	}
+	defer cc.Close()
+	d.serveBackend(newBackend(c, rh2Transport{cc}))
+}
+
+// rh2Transport sends requests on an rh2 connection.
+// Requests from the router's listeners, and the names
+// and health requests, don't all carry an absolute URL,
+// which HTTP/2 needs for its pseudo-header fields.
+type rh2Transport struct {
+	cc *http2.ClientConn
+}
+
+func (t rh2Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Scheme == "" || r.URL.Host == "" {
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.Scheme = "https"
+		if u.Host == "" {
+			u.Host = r.Host
+		}
+		r2.URL = &u
+		r = r2
+	}
+	return t.cc.RoundTrip(r)
+}
+
+// CanTakeNewRequest reports whether the connection has a
+// stream free. If not, RoundTrip would wait for one.
+func (t rh2Transport) CanTakeNewRequest() bool {
+	return t.cc.CanTakeNewRequest()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/fernet/fernet-go"
+	"github.com/kr/webx"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// An rh2Loopback is a webx client connected to a
+// directory over rh2, serving app foo.
+type rh2Loopback struct {
+	d      *Directory
+	client *webx.Client
+	errc   chan error // from client.Serve
+	l      net.Listener
+	keys   []*fernet.Key
+}
+
+// newRH2Loopback starts a loopback whose client serves h,
+// and waits for foo to be routable.
+func newRH2Loopback(t *testing.T, h http.Handler) *rh2Loopback {
+	lb := &rh2Loopback{keys: fernetKeys}
+	k := new(fernet.Key)
+	if err := k.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	fernetKeys = []*fernet.Key{k}
+	tok, err := fernet.EncryptAndSign([]byte("foo"), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Borrow httptest's certificate for 127.0.0.1.
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	cert := ts.TLS.Certificates[0]
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	ts.Close()
+
+	lb.l, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{rh2Proto, "rspdy/3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Directory{tab: make(map[string]*Group)}
+	lb.d = d
+	go func() {
+		for {
+			c, err := lb.l.Accept()
+			if err != nil {
+				return
+			}
+			tc := c.(*tls.Conn)
+			if err := tc.Handshake(); err != nil || tc.ConnectionState().NegotiatedProtocol != rh2Proto {
+				c.Close()
+				continue
+			}
+			go func() {
+				d.ServeRH2(nil, tc, nil)
+				tc.Close()
+			}()
+		}
+	}()
+
+	u := &url.URL{Scheme: "https", Host: lb.l.Addr().String(), User: url.UserPassword("foo", string(tok))}
+	lb.client = &webx.Client{
+		URL:       u.String(),
+		TLSConfig: &tls.Config{RootCAs: roots},
+		Protos:    []string{webx.ProtoRH2},
+		Handler:   h,
+	}
+	lb.errc = make(chan error, 1)
+	go func() { lb.errc <- lb.client.Serve(context.Background()) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if g := d.Get("foo"); g != nil && g.route(nil) != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			lb.Close()
+			t.Fatal("backend never became routable")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return lb
+}
+
+func (lb *rh2Loopback) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lb.client.Shutdown(ctx)
+	lb.l.Close()
+	fernetKeys = lb.keys
+}
+
+func TestRH2Loopback(t *testing.T) {
+	lb := newRH2Loopback(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.Host)
+	}))
+	defer lb.Close()
+	d := lb.d
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Host = "foo." + webx.AppDomain
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, r)
+	if got, want := w.Body.String(), "hello from foo."+webx.AppDomain; w.Code != 200 || got != want {
+		t.Errorf("response = %d %q want 200 %q", w.Code, got, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := lb.client.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown = %v", err)
+	}
+	if err := <-lb.errc; err != webx.ErrDrained {
+		t.Errorf("Serve = %v want ErrDrained", err)
+	}
+	g := d.Get("foo")
+	for i := 0; i < 100 && numBackends(g) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := numBackends(g); n != 0 {
+		t.Errorf("%d backends after drain, want 0", n)
+	}
+}
+
+func numBackends(g *Group) int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return len(g.backends)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/kr/webx"
+	"log"
+	"net/http"
+	"os"
+)
+
+// tracer exports a span for each request to the OTLP
+// collector at OTLPURL, e.g. http://localhost:4318/v1/traces.
+// If OTLPURL is unset, tracer is nil, and trace context
+// passes through the router unchanged.
+var tracer *webx.Tracer
+
+func newTracer() *webx.Tracer {
+	url := os.Getenv("OTLPURL")
+	if url == "" {
+		return nil
+	}
+	return &webx.Tracer{
+		URL:      url,
+		Service:  "urouter",
+		ErrorLog: log.New(os.Stderr, "", log.Lshortfile|log.LstdFlags),
+	}
+}
+
+// traceHandler starts a span for each request and passes
+// it to the backend in the traceparent header field. It
+// should be wrapped by accessLogHandler, so it can record
+// the app and backend, and log the trace ID.
+func traceHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tracer == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		s := tracer.StartRequest(r, "HTTP "+r.Method)
+		s.SetAttr("webx.request_id", r.Header.Get("Id"))
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		if sw.code != 0 {
+			s.SetStatus(sw.code)
+		}
+		if e := logEntryFrom(r); e != nil {
+			e.TraceID = s.TraceIDString()
+			s.SetAttr("webx.app", e.App)
+			s.SetAttr("webx.backend", e.Backend)
+			s.SetAttr("webx.tries", e.Tries)
+			if e.Err != "" {
+				s.SetError(e.Err)
+			}
+		}
+		s.Finish()
+	})
+}
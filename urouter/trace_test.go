@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/kr/webx"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTraceHandler(t *testing.T) {
+	got := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got <- b
+	}))
+	defer collector.Close()
+	defer func(t *webx.Tracer) { tracer = t }(tracer)
+	tracer = &webx.Tracer{URL: collector.URL, Service: "urouter"}
+
+	var forwarded string
+	h := accessLogHandler(traceHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logEntryFrom(r).App = "foo"
+		forwarded = r.Header.Get("Traceparent")
+		w.WriteHeader(200)
+	})), nil)
+	r, _ := http.NewRequest("GET", "http://foo.webxapp.io/", nil)
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(new(resp), r)
+
+	if !strings.HasPrefix(forwarded, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.Contains(forwarded, "00f067aa0ba902b7") {
+		t.Errorf("forwarded traceparent = %q, want a child span", forwarded)
+	}
+	if err := tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var req map[string]interface{}
+	if err := json.Unmarshal(<-got, &req); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(req)
+	if !strings.Contains(string(b), `"key":"webx.app","value":{"stringValue":"foo"}`) {
+		t.Errorf("export = %s, want webx.app attribute", b)
+	}
+}
@@ -1,23 +1,69 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// WebsocketProxy proxies websocket connections to a backend,
+// and passes other requests on to handler.
+//
+// The backend gets a WEBSOCKET request whose body is the
+// client's upgrade request followed by the client's frames.
+// It answers 200, with a body that is the app's own raw
+// response to the upgrade followed by the app's frames.
+// WebsocketProxy reads the app's response: if it is 101,
+// the proxy finishes the upgrade with the client and relays
+// frames both ways; otherwise it sends the response on to
+// the client as it is.
+//
+// The upgrade travels in a body because rh2 can't carry it:
+// HTTP/2 forbids Upgrade and Connection headers and 101
+// responses.
 type WebsocketProxy struct {
 	handler   http.Handler
 	transport http.RoundTripper
 }
 
+// How often to ping a websocket client. A client that
+// sends nothing, not even a pong, for two intervals is
+// taken to be gone.
+var wsPingInterval = 30 * time.Second
+
+// How long a websocket client has to take each write
+// from us. One that stops reading is dropped, rather
+// than holding up the app's frames and our pings.
+var wsWriteTimeout = 10 * time.Second
+
+// wsPing is the payload of our pings. Pongs that carry
+// it are answers to us, and aren't passed on to the app.
+var wsPing = []byte("webx")
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Websocket opcodes.
+const (
+	wsClose  = 0x8
+	wsPingOp = 0x9
+	wsPongOp = 0xa
+)
+
 func (p *WebsocketProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// We don't do the websocket handshake, we just decide whether
-	// to proxy it as a websocket. The backend does the handshake.
-	if r.Header.Get("Upgrade") == "websocket" {
+	if headerContains(r.Header, "Upgrade", "websocket") {
 		p.Proxy(w, r)
 		return
 	}
@@ -25,37 +71,326 @@ func (p *WebsocketProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (p *WebsocketProxy) Proxy(w http.ResponseWriter, r *http.Request) {
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		log.Println("hijack assertion failed", r.Host, r.URL.Path)
-		p.handler.ServeHTTP(w, r) // last-ditch effort as plain http
+	if code, msg := checkUpgrade(r); code != 0 {
+		if code == http.StatusUpgradeRequired {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+		}
+		http.Error(w, msg, code)
 		return
 	}
-	conn, rw, err := hj.Hijack()
-	if err != nil {
-		log.Println("hijack failed", r.Host, r.URL.Path, err)
-		p.handler.ServeHTTP(w, r) // last-ditch effort as plain http
+	// Check before asking the app, so a client we can't
+	// upgrade never gets the app's 101 as an empty 200.
+	if !canHijack(w) {
+		http.Error(w, "websocket needs HTTP/1.1", http.StatusNotImplemented)
 		return
 	}
-	defer conn.Close()
-	rw.Flush()
 
+	var buf bytes.Buffer
+	r.Write(&buf)
+	pr, pw := io.Pipe() // the client's frames, after the upgrade
+	defer pw.Close()
 	wrapreq := new(http.Request)
 	wrapreq.Proto = "HTTP/1.1"
 	wrapreq.ProtoMajor, wrapreq.ProtoMinor = 1, 1
 	wrapreq.Method = "WEBSOCKET"
 	wrapreq.Host = r.Host
+	wrapreq.Header = make(http.Header)
 	const dummy = "/"
 	wrapreq.URL = &url.URL{Path: dummy}
-	var buf bytes.Buffer
-	r.Write(&buf)
-	wrapreq.Body = ioutil.NopCloser(io.MultiReader(&buf, conn))
+	wrapreq.ContentLength = -1
+	wrapreq.Body = ioutil.NopCloser(io.MultiReader(&buf, pr))
+	wrapreq = wrapreq.WithContext(r.Context())
 	resp, err := p.transport.RoundTrip(wrapreq)
-	if err != nil || resp.StatusCode != 200 {
-		io.WriteString(conn, "HTTP/1.0 503 Gateway Failed\r\n")
-		io.WriteString(conn, "Connection: close\r\n\r\n")
+	if err != nil {
+		log.Println("error: websocket", r.Host, err)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return
+	}
+	defer func() {
+		// End the request body first: over rh2, closing
+		// the response waits for the request to finish.
+		pw.Close()
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != 200 {
+		copyResponse(w, resp)
+		return
+	}
+	br := bufio.NewReader(resp.Body)
+	inner, err := http.ReadResponse(br, r)
+	if err != nil {
+		log.Println("error: websocket response", r.Host, err)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
 		return
 	}
-	defer resp.Body.Close()
-	io.Copy(conn, resp.Body)
+	if inner.StatusCode != http.StatusSwitchingProtocols {
+		copyResponse(w, inner)
+		return
+	}
+	if inner.Header.Get("Sec-WebSocket-Accept") != wsAccept(r.Header.Get("Sec-WebSocket-Key")) {
+		log.Println("error: websocket", r.Host, "bad Sec-WebSocket-Accept from app")
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return
+	}
+
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Println("hijack failed", r.Host, r.URL.Path, err)
+		return
+	}
+	defer conn.Close()
+	if e := logEntryFrom(r); e != nil {
+		e.Status = http.StatusSwitchingProtocols
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	inner.Header.Write(rw)
+	rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+	websocketTotal.add(1)
+	websocketSessions.add(1)
+	defer websocketSessions.add(-1)
+
+	ws := &wsConn{conn: conn}
+	ws.touch()
+	done := make(chan bool)
+	defer close(done)
+	go ws.keepalive(wsPingInterval, done)
+	errc := make(chan error, 2)
+	go func() { errc <- ws.fromClient(pw, rw.Reader) }()
+	go func() { errc <- ws.toClient(br) }()
+	<-errc
+}
+
+// canHijack reports whether w can be hijacked. Wrappers
+// like statusWriter always have a Hijack method, so it
+// looks through them, with Unwrap, to the server's own
+// ResponseWriter.
+func canHijack(w http.ResponseWriter) bool {
+	for {
+		switch t := w.(type) {
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		case http.Hijacker:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// checkUpgrade validates a websocket upgrade request
+// (RFC 6455, section 4.2.1). If it's bad, checkUpgrade
+// returns a status code and message for the client.
+func checkUpgrade(r *http.Request) (code int, msg string) {
+	if r.Method != "GET" {
+		return http.StatusMethodNotAllowed, "websocket upgrade must be GET"
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") {
+		return http.StatusBadRequest, "missing Connection: upgrade"
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return http.StatusUpgradeRequired, "unsupported websocket version"
+	}
+	key, err := base64.StdEncoding.DecodeString(r.Header.Get("Sec-WebSocket-Key"))
+	if err != nil || len(key) != 16 {
+		return http.StatusBadRequest, "bad Sec-WebSocket-Key"
+	}
+	return 0, ""
+}
+
+// headerContains reports whether the comma-separated
+// list in header field k of h contains token, ignoring case.
+func headerContains(h http.Header, k, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(k)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// copyResponse sends resp to w, as a failed upgrade.
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	for k, v := range resp.Header {
+		switch k {
+		case "Connection", "Upgrade", "Transfer-Encoding", "Keep-Alive":
+			continue
+		}
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// A wsConn relays frames between a websocket client and
+// the app, and pings the client to keep the connection
+// alive through idle timeouts and to notice when it's gone.
+// Its writes time out after wsWriteTimeout.
+type wsConn struct {
+	lastRead int64 // unix nanoseconds; accessed atomically
+
+	mu   sync.Mutex // serializes frames to the client
+	conn net.Conn
+}
+
+// Write writes p to the client. Caller holds c.mu.
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.Write(p)
+}
+
+func (c *wsConn) touch() {
+	atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+}
+
+func (c *wsConn) keepalive(d time.Duration, done <-chan bool) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead)))
+		if idle > 2*d {
+			c.conn.Close()
+			return
+		}
+		c.mu.Lock()
+		_, err := c.Write(wsFrame(wsPingOp, wsPing))
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// fromClient relays frames from the client to the app,
+// dropping answers to our pings.
+func (c *wsConn) fromClient(dst io.Writer, src *bufio.Reader) error {
+	for {
+		h, err := readWSHeader(src)
+		if err != nil {
+			return err
+		}
+		c.touch()
+		if !h.masked {
+			// RFC 6455, section 5.1: clients must mask.
+			c.mu.Lock()
+			c.Write(wsFrame(wsClose, []byte{0x03, 0xea})) // 1002, protocol error
+			c.mu.Unlock()
+			return errors.New("unmasked frame from client")
+		}
+		if h.op == wsPongOp && h.n == int64(len(wsPing)) {
+			p := make([]byte, h.n)
+			if _, err := io.ReadFull(src, p); err != nil {
+				return err
+			}
+			for i := range p {
+				p[i] ^= h.mask[i%4]
+			}
+			if bytes.Equal(p, wsPing) {
+				continue
+			}
+			for i := range p {
+				p[i] ^= h.mask[i%4]
+			}
+			if _, err := dst.Write(append(h.raw, p...)); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := dst.Write(h.raw); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, src, h.n); err != nil {
+			return err
+		}
+	}
+}
+
+// toClient relays frames from the app to the client.
+// Each frame is written whole, so pings go between frames.
+func (c *wsConn) toClient(src *bufio.Reader) error {
+	for {
+		h, err := readWSHeader(src)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		_, err = c.Write(h.raw)
+		if err == nil {
+			_, err = io.CopyN(c, src, h.n)
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type wsHeader struct {
+	op     byte
+	masked bool
+	mask   [4]byte
+	n      int64  // payload length
+	raw    []byte // the header as read
+}
+
+// readWSHeader reads a frame header (RFC 6455, section 5.2).
+func readWSHeader(r *bufio.Reader) (h wsHeader, err error) {
+	var b [14]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return h, err
+	}
+	h.op = b[0] & 0xf
+	h.masked = b[1]&0x80 != 0
+	n := 2
+	switch l := b[1] & 0x7f; l {
+	case 126:
+		if _, err := io.ReadFull(r, b[n:n+2]); err != nil {
+			return h, err
+		}
+		h.n = int64(binary.BigEndian.Uint16(b[n:]))
+		n += 2
+	case 127:
+		if _, err := io.ReadFull(r, b[n:n+8]); err != nil {
+			return h, err
+		}
+		h.n = int64(binary.BigEndian.Uint64(b[n:]))
+		if h.n < 0 {
+			return h, errors.New("websocket frame too long")
+		}
+		n += 8
+	default:
+		h.n = int64(l)
+	}
+	if h.op >= wsClose && h.n > 125 {
+		return h, errors.New("websocket control frame too long")
+	}
+	if h.masked {
+		if _, err := io.ReadFull(r, b[n:n+4]); err != nil {
+			return h, err
+		}
+		copy(h.mask[:], b[n:])
+		n += 4
+	}
+	h.raw = append([]byte(nil), b[:n]...)
+	return h, nil
+}
+
+// wsFrame returns an unmasked, final frame with a
+// short payload, as a server sends.
+func wsFrame(op byte, p []byte) []byte {
+	return append([]byte{0x80 | op, byte(len(p))}, p...)
 }
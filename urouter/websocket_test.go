@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testWSKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+func TestCheckUpgrade(t *testing.T) {
+	cases := []struct {
+		method string
+		h      http.Header
+		code   int
+	}{
+		{"GET", http.Header{"Connection": {"keep-alive, Upgrade"}, "Sec-Websocket-Version": {"13"}, "Sec-Websocket-Key": {testWSKey}}, 0},
+		{"POST", http.Header{"Connection": {"Upgrade"}, "Sec-Websocket-Version": {"13"}, "Sec-Websocket-Key": {testWSKey}}, 405},
+		{"GET", http.Header{"Sec-Websocket-Version": {"13"}, "Sec-Websocket-Key": {testWSKey}}, 400},
+		{"GET", http.Header{"Connection": {"Upgrade"}, "Sec-Websocket-Version": {"8"}, "Sec-Websocket-Key": {testWSKey}}, 426},
+		{"GET", http.Header{"Connection": {"Upgrade"}, "Sec-Websocket-Version": {"13"}, "Sec-Websocket-Key": {"short"}}, 400},
+	}
+	for i, c := range cases {
+		r := &http.Request{Method: c.method, Header: c.h}
+		if code, _ := checkUpgrade(r); code != c.code {
+			t.Errorf("%d: code = %d want %d", i, code, c.code)
+		}
+	}
+}
+
+func TestWSAccept(t *testing.T) {
+	// From RFC 6455, section 1.3.
+	const want = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	if g := wsAccept(testWSKey); g != want {
+		t.Errorf("wsAccept = %q want %q", g, want)
+	}
+}
+
+// appTransport sends WEBSOCKET requests to the app
+// listening on l, as webxd does.
+func appTransport(l net.Listener) http.RoundTripper {
+	return funcTransport(func(r *http.Request) (*http.Response, error) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		go io.Copy(c, r.Body)
+		return &http.Response{StatusCode: 200, Header: make(http.Header), Body: c}, nil
+	})
+}
+
+// echoApp accepts one websocket on l and echoes
+// its frames back, unmasked, as text.
+func echoApp(t *testing.T, l net.Listener) {
+	c, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	r, err := http.ReadRequest(br)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+wsAccept(r.Header.Get("Sec-WebSocket-Key"))+"\r\n\r\n")
+	for {
+		h, err := readWSHeader(br)
+		if err != nil {
+			return
+		}
+		p := make([]byte, h.n)
+		io.ReadFull(br, p)
+		for i := range p {
+			p[i] ^= h.mask[i%4]
+		}
+		c.Write(wsFrame(0x1, p))
+	}
+}
+
+// dialWS opens a websocket to the server at addr.
+func dialWS(t *testing.T, addr string) (net.Conn, *bufio.Reader, *http.Response) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(c, "GET /chat HTTP/1.1\r\nHost: foo.webxapp.io\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: "+testWSKey+"\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, br, resp
+}
+
+// writeMasked writes a masked frame, as a client does.
+func writeMasked(w io.Writer, op byte, p []byte) {
+	mask := []byte{1, 2, 3, 4}
+	b := append([]byte{0x80 | op, 0x80 | byte(len(p))}, mask...)
+	for i, c := range p {
+		b = append(b, c^mask[i%4])
+	}
+	w.Write(b)
+}
+
+func readFrame(t *testing.T, br *bufio.Reader) (op byte, p []byte) {
+	h, err := readWSHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = make([]byte, h.n)
+	if _, err := io.ReadFull(br, p); err != nil {
+		t.Fatal(err)
+	}
+	return h.op, p
+}
+
+func TestWebsocketProxy(t *testing.T) {
+	defer func(d time.Duration) { wsPingInterval = d }(wsPingInterval)
+	wsPingInterval = 20 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go echoApp(t, l)
+	ts := httptest.NewServer(&WebsocketProxy{transport: appTransport(l)})
+	defer ts.Close()
+
+	c, br, resp := dialWS(t, ts.Listener.Addr().String())
+	defer c.Close()
+	if resp.StatusCode != 101 {
+		t.Fatalf("status = %d want 101", resp.StatusCode)
+	}
+	if g := resp.Header.Get("Sec-WebSocket-Accept"); g != wsAccept(testWSKey) {
+		t.Errorf("Sec-WebSocket-Accept = %q", g)
+	}
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	op, p := readFrame(t, br)
+	if op != wsPingOp || string(p) != "webx" {
+		t.Fatalf("got op %#x %q, want ping", op, p)
+	}
+	writeMasked(c, wsPongOp, p) // must not reach the app
+	writeMasked(c, 0x1, []byte("hi"))
+	for {
+		op, p = readFrame(t, br)
+		if op != wsPingOp {
+			break
+		}
+	}
+	if op != 0x1 || string(p) != "hi" {
+		t.Errorf("got op %#x %q, want text hi", op, p)
+	}
+}
+
+func TestWebsocketProxyRefused(t *testing.T) {
+	cases := []struct {
+		transport http.RoundTripper
+		code      int
+		body      string
+	}{
+		{funcTransport(func(r *http.Request) (*http.Response, error) {
+			const s = "HTTP/1.1 403 Forbidden\r\nContent-Length: 4\r\n\r\nnope"
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(s))}, nil
+		}), 403, "nope"},
+		{funcTransport(func(r *http.Request) (*http.Response, error) {
+			const s = "HTTP/1.1 101 Switching Protocols\r\nSec-WebSocket-Accept: wrong\r\n\r\n"
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(s))}, nil
+		}), 502, "bad gateway\n"},
+		{statusTransport(503), 503, ""},
+		{funcTransport(func(*http.Request) (*http.Response, error) {
+			return nil, errors.New("broken")
+		}), 502, "bad gateway\n"},
+	}
+	for i, test := range cases {
+		ts := httptest.NewServer(&WebsocketProxy{transport: test.transport})
+		c, br, resp := dialWS(t, ts.Listener.Addr().String())
+		body, _ := ioutil.ReadAll(io.LimitReader(br, resp.ContentLength))
+		c.Close()
+		ts.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%d: status = %d want %d", i, resp.StatusCode, test.code)
+		}
+		if string(body) != test.body {
+			t.Errorf("%d: body = %q want %q", i, body, test.body)
+		}
+	}
+}
+
+func TestWebsocketProxyNoHijack(t *testing.T) {
+	called := false
+	p := &WebsocketProxy{transport: funcTransport(func(*http.Request) (*http.Response, error) {
+		called = true
+		return nil, errors.New("unreachable")
+	})}
+	r, _ := http.NewRequest("GET", "http://foo.webxapp.io/chat", nil)
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", testWSKey)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(&statusWriter{ResponseWriter: w}, r)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("status = %d want %d", w.Code, http.StatusNotImplemented)
+	}
+	if called {
+		t.Error("app got the upgrade")
+	}
+}
+
+func TestWSWriteTimeout(t *testing.T) {
+	defer func(d time.Duration) { wsWriteTimeout = d }(wsWriteTimeout)
+	wsWriteTimeout = 10 * time.Millisecond
+	client, conn := net.Pipe() // writes block until the client reads
+	defer client.Close()
+	c := &wsConn{conn: conn}
+	src := bufio.NewReader(strings.NewReader(string(wsFrame(0x1, []byte("hi")))))
+	errc := make(chan error)
+	go func() { errc <- c.toClient(src) }()
+	select {
+	case err := <-errc:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("toClient = %v want timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("toClient blocked on a client that doesn't read")
+	}
+}
+
+func TestWebsocketRefusedRH2(t *testing.T) {
+	defer func(w io.Writer) { accessLogOut = w }(accessLogOut)
+	accessLogOut = ioutil.Discard
+
+	// The backend answers as webxd does, with the app's
+	// raw response to the upgrade in the body.
+	lb := newRH2Loopback(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "WEBSOCKET" {
+			io.WriteString(w, "not a websocket")
+			return
+		}
+		if _, err := http.ReadRequest(bufio.NewReader(r.Body)); err != nil {
+			t.Error(err)
+		}
+		io.WriteString(w, "HTTP/1.1 403 Forbidden\r\nContent-Length: 4\r\n\r\nnope")
+	}))
+	defer lb.Close()
+	ts := httptest.NewServer(idHandler(accessLogHandler(lb.d, nil)))
+	defer ts.Close()
+
+	c, br, resp := dialWS(t, ts.Listener.Addr().String())
+	defer c.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(br, resp.ContentLength))
+	if resp.StatusCode != 403 || string(body) != "nope" {
+		t.Errorf("response = %d %q want 403 nope", resp.StatusCode, body)
+	}
+}
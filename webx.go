@@ -2,53 +2,78 @@ package webx
 
 import (
 	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"net/http"
-	neturl "net/url"
-	"strings"
-
-	"github.com/kr/rspdy"
 )
 
+// ErrDrained is returned by Client.Serve and DialAndServe
+// after the client has been drained or shut down.
+var ErrDrained = errors.New("webx: client drained")
+
+// ErrClosed is returned by Client.Serve and DialAndServe
+// when they are called after Shutdown.
+var ErrClosed = errors.New("webx: client shut down")
+
+// errClosed is returned from serving an rh2 connection,
+// which ends without an error of its own.
+var errClosed = errors.New("webx: connection closed")
+
+// DialAndServeTLS makes one connection to the router at url
+// and serves requests from it until the connection ends.
+// For redialing and clean shutdown, use Client.
 func DialAndServeTLS(url string, tlsConfig *tls.Config, h http.Handler) error {
-	u, err := neturl.Parse(url)
-	if err != nil {
-		return err
-	}
-	if u.User == nil {
-		return errors.New("url has no userinfo")
-	}
-	if u.Scheme != "https" {
-		return errors.New("scheme must be https")
-	}
+	c := &Client{URL: url, TLSConfig: tlsConfig, Handler: h}
+	return c.DialAndServe()
+}
 
-	name := u.User.Username()
-	password, _ := u.User.Password()
-	cmd, err := json.Marshal(Command{"add", name, password})
-	if err != nil {
-		return err
-	}
-	handshake := func(w http.ResponseWriter, r *http.Request) {
-		w.Write(cmd)
-		select {}
+func writeFlush(w http.ResponseWriter, p []byte) {
+	w.Write(p)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
 	}
+}
 
-	if h == nil {
-		h = http.DefaultServeMux
-	}
-	mux := http.NewServeMux()
-	mux.Handle("/", h)
-	mux.HandleFunc("backend.webx.io/names", handshake)
-	addr := u.Host
-	if !strings.Contains(addr, ":") {
-		addr += ":https"
-	}
-	return rspdy.DialAndServeTLS("tcp", addr, tlsConfig, mux)
+// HealthPath is where an app gets the router's health checks.
+const HealthPath = "/health"
+
+// health passes the router's health checks on to the app's
+// handler h, as GET HealthPath, so a hung or broken app
+// fails them. An app need not serve HealthPath: any answer
+// but a 5xx, such as 404, shows it's alive.
+func health(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = HealthPath
+		r2.URL.RawPath = ""
+		r2.RequestURI = HealthPath
+		h.ServeHTTP(w, r2)
+	})
 }
 
 type Command struct {
-	Op       string // "add" or "remove"
+	Op       string // "add", "mon", "remove", or "drain"
 	Name     string // e.g. "foo" for foo.webxapp.io
 	Password string
+	Weight   int  // share of the app's traffic, for weighted balancing
+	Ack      bool // ask the router to send a Reply
+}
+
+// A Reply is the router's answer to a Command with Ack set.
+// The router sends each one as the JSON body of a POST
+// request to BackendHost/names/reply.
+type Reply struct {
+	Op    string // from the Command
+	Name  string // from the Command
+	Error string // e.g. "unauthorized"; empty on success
+}
+
+// A NameError is returned by Client.Serve
+// when the router rejects every app name.
+type NameError struct {
+	Name string
+	Err  string
+}
+
+func (e *NameError) Error() string {
+	return "webx: router rejected " + e.Name + ": " + e.Err
 }
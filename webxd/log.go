@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/kr/webx/internal/logline"
+	"log"
+	"net/http"
+	"time"
+)
+
+var logFormat string // WEBX_LOG
+
+// logRequest writes one line about r to the log. The id is
+// the one the router gave the request, so this line can be
+// matched with the router's. The ms field is the time the
+// app took; the router's upstream_ms for the same request
+// is that plus the time spent in the tunnel.
+func logRequest(r *http.Request, w *LogResponseWriter, d time.Duration, traceID string) {
+	if logFormat == "" || logFormat == "off" {
+		return
+	}
+	f := [][2]interface{}{
+		{"id", r.Header.Get("Id")},
+		{"method", r.Method},
+		{"host", r.Host},
+		{"path", r.URL.Path},
+		{"status", w.code},
+		{"bytes", w.n},
+		{"ms", float64(d) / float64(time.Millisecond)},
+	}
+	if dyno != "" {
+		f = append(f, [2]interface{}{"dyno", dyno})
+	}
+	if w.err != nil {
+		f = append(f, [2]interface{}{"error", w.err.Error()})
+	}
+	if traceID != "" {
+		f = append(f, [2]interface{}{"trace_id", traceID})
+	}
+	if logFormat == "json" {
+		log.Println(string(logline.JSON(f)))
+	} else {
+		log.Println(string(logline.Logfmt(f)))
+	}
+}
@@ -3,15 +3,37 @@
 //   PORT     - port to send requests to
 //   WEBX_URL - location and credentials for RSPDY connection
 //              e.g. https://foo@route.webx.io/
+//              optional query parameter weight sets this
+//              dyno's share of traffic, e.g. ?weight=2
+//              and pin restricts the router's certificate,
+//              e.g. ?pin=sha256/base64hash
 //
 // Optional Environment:
 //   WEBX_VERBOSE - log extra information
+//   WEBX_CA_FILE - PEM file of CA certs to trust for the router,
+//                  instead of the system roots
+//   WEBX_PIN     - comma-separated SPKI pins for the router,
+//                  e.g. sha256/base64hash
+//   WEBX_CONNS   - number of connections to keep open to the
+//                  router, default 1
+//   WEBX_PROTO   - comma-separated reverse transports to offer
+//                  the router, default rh2,rspdy/3
+//   WEBX_LOG     - request log format: logfmt, json, or off;
+//                  default logfmt if WEBX_VERBOSE is set,
+//                  otherwise off
+//   WEBX_METRICS_ADDR - address to serve Prometheus metrics
+//                  on, at /metrics, e.g. 127.0.0.1:9102
+//   WEBX_OTLP_URL - OTLP/HTTP traces endpoint to export spans
+//                  to, e.g. http://localhost:4318/v1/traces
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"github.com/kr/webx"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -19,22 +41,23 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
 const (
-	redialPause = 2 * time.Second
+	drainTimeout = 25 * time.Second // heroku sends SIGKILL after 30s
 )
 
 var (
 	verbose bool
 	dyno    = os.Getenv("DYNO")
+	tracer  *webx.Tracer // nil unless WEBX_OTLP_URL is set
 )
 
-var tlsConfig = &tls.Config{
-	InsecureSkipVerify: true,
-}
-
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("webxd: ")
@@ -45,56 +68,191 @@ func main() {
 	switch mode {
 	case "web":
 		innerURL := &url.URL{Scheme: "http", Host: ":" + os.Getenv("PORT")}
-		rp := httputil.NewSingleHostReverseProxy(innerURL)
-		rp.Transport = new(WebsocketTransport)
-		http.Handle("/", LogHandler{rp})
-		http.HandleFunc("backend.webx.io/mon/ps", ListProc)
+		http.Handle("/", LogHandler{newProxy(innerURL)})
+		http.HandleFunc(webx.BackendHost+"/mon/ps", ListProc)
 	case "mon":
-		http.HandleFunc("backend.webx.io/mon/ps", ListProc)
+		http.HandleFunc(webx.BackendHost+"/mon/ps", ListProc)
 	}
 	if os.Getenv("WEBX_VERBOSE") != "" {
 		verbose = true
 	}
-	for {
-		err := webx.DialAndServeTLS(os.Getenv("WEBX_URL"), tlsConfig, nil)
+	logFormat = os.Getenv("WEBX_LOG")
+	switch logFormat {
+	case "":
+		if verbose {
+			logFormat = "logfmt"
+		}
+	case "logfmt", "json", "off":
+	default:
+		log.Fatal("WEBX_LOG must be logfmt, json, or off")
+	}
+	if u := os.Getenv("WEBX_OTLP_URL"); u != "" {
+		tracer = &webx.Tracer{URL: u, Service: "webxd", ErrorLog: log.New(os.Stderr, "webxd: ", 0)}
+	}
+	if addr := os.Getenv("WEBX_METRICS_ADDR"); addr != "" {
+		go listenMetrics(addr)
+	}
+	client := &webx.Client{
+		URL:       os.Getenv("WEBX_URL"),
+		TLSConfig: tlsConfig(),
+		ConnState: func(conn int, addr string, state webx.ConnState) {
+			Infoln("router", addr, "conn", conn, state)
+			routerConnState(conn, state)
+		},
+	}
+	if s := os.Getenv("WEBX_PIN"); s != "" {
+		client.Pins = strings.Split(s, ",")
+	}
+	if s := os.Getenv("WEBX_PROTO"); s != "" {
+		client.Protos = strings.Split(s, ",")
+	}
+	if s := os.Getenv("WEBX_CONNS"); s != "" {
+		n, err := strconv.Atoi(s)
 		if err != nil {
-			log.Println("DialAndServe:", err)
-			log.Println("DialAndServe:", os.Getenv("WEBX_URL"))
-			time.Sleep(redialPause)
+			log.Fatal("WEBX_CONNS: ", err)
 		}
+		client.Conns = n
+	}
+	go drainOnTerm(client)
+	err := client.Serve(context.Background())
+	if err := tracer.Close(); err != nil {
+		log.Println("export spans:", err)
+	}
+	if err != webx.ErrDrained && err != webx.ErrClosed {
+		log.Fatal(err)
+	}
+	log.Println("drained")
+}
+
+// tlsConfig returns the TLS config for the router connection.
+// By default, the router's certificate is verified against
+// the system roots.
+func tlsConfig() *tls.Config {
+	config := new(tls.Config)
+	if file := os.Getenv("WEBX_CA_FILE"); file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			log.Fatal("no certificates in ", file)
+		}
+	}
+	return config
+}
+
+// drainOnTerm drains c when the process gets SIGTERM,
+// so requests in flight can finish before we exit.
+func drainOnTerm(c *webx.Client) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM)
+	<-sig
+	log.Println("draining")
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		log.Println("drain:", err)
 	}
 }
 
+// LogHandler logs each request after it is served
+// and records it in the metrics.
 type LogHandler struct {
 	http.Handler
 }
 
 func (h LogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w = &LogResponseWriter{ResponseWriter: w, r: r}
-	h.Handler.ServeHTTP(w, r)
+	lw := &LogResponseWriter{ResponseWriter: w}
+	span := tracer.StartRequest(r, "HTTP "+r.Method)
+	span.SetAttr("webx.dyno", dyno)
+	start := time.Now()
+	g := &requestsInFlight
+	if r.Method == "WEBSOCKET" {
+		g = &websocketSessions
+	}
+	g.Add(1)
+	h.Handler.ServeHTTP(lw, r)
+	g.Add(-1)
+	d := time.Since(start)
+	if lw.code == 0 {
+		lw.code = http.StatusOK
+	}
+	observeRequest(r, lw.code, d)
+	span.SetStatus(lw.code)
+	if lw.err != nil {
+		span.SetError(lw.err.Error())
+	}
+	span.Finish()
+	logRequest(r, lw, d, span.TraceIDString())
 }
 
+// LogResponseWriter records what was written to it,
+// for the log line.
 type LogResponseWriter struct {
 	http.ResponseWriter
-	r      *http.Request
-	logged bool
+	code int
+	n    int64
+	err  error // from the inner proxy
 }
 
 func (w *LogResponseWriter) Write(p []byte) (int, error) {
-	w.log(http.StatusOK)
-	return w.ResponseWriter.Write(p)
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
 }
 
 func (w *LogResponseWriter) WriteHeader(code int) {
-	w.log(code)
+	if w.code == 0 {
+		w.code = code
+	}
 	w.ResponseWriter.WriteHeader(code)
 }
 
-func (w *LogResponseWriter) log(code int) {
-	if !w.logged {
-		w.logged = true
-		Infoln(code, w.r.Host, w.r.URL.Path)
+// Flush sends any buffered data to the router, so
+// streaming responses stream all the way through.
+func (w *LogResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// newProxy returns a reverse proxy to the inner app at u.
+func newProxy(u *url.URL) *httputil.ReverseProxy {
+	rp := &httputil.ReverseProxy{Rewrite: func(pr *httputil.ProxyRequest) {
+		pr.SetURL(u)
+		rewrite(pr)
+	}}
+	rp.FlushInterval = -1 // stream responses as they come
+	rp.Transport = new(WebsocketTransport)
+	rp.ErrorHandler = proxyError
+	return rp
+}
+
+// rewrite passes the request on to the inner app as the
+// router sent it: with its Host, its forwarding header
+// fields, which the router has already set, and its
+// trailers, which ReverseProxy would otherwise drop.
+func rewrite(pr *httputil.ProxyRequest) {
+	pr.Out.Host = pr.In.Host
+	for _, k := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+		if v, ok := pr.In.Header[k]; ok {
+			pr.Out.Header[k] = v
+		}
 	}
+	pr.Out.Trailer = pr.In.Trailer
+}
+
+// proxyError is the ErrorHandler for the inner proxy.
+// It keeps err for the log line.
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if lw, ok := w.(*LogResponseWriter); ok {
+		lw.err = err
+	}
+	w.WriteHeader(http.StatusBadGateway)
 }
 
 func Infoln(v ...interface{}) {
@@ -103,17 +261,33 @@ func Infoln(v ...interface{}) {
 	}
 }
 
+// WebsocketTransport sends WEBSOCKET requests from the
+// router straight to the app as raw bytes: the body is the
+// client's upgrade request followed by its frames, and the
+// response body is the app's raw response followed by its
+// frames. The router reads the app's response and finishes
+// the upgrade itself. Other requests go to DefaultTransport.
 type WebsocketTransport struct{}
 
+const websocketDialTimeout = 10 * time.Second
+
 func (w WebsocketTransport) Proxy(req *http.Request) (*http.Response, error) {
-	conn, err := net.DialTimeout("tcp", req.URL.Host, 50*time.Millisecond)
+	d := net.Dialer{Timeout: websocketDialTimeout}
+	conn, err := d.DialContext(req.Context(), "tcp", req.URL.Host)
 	if err != nil {
 		return nil, err
 	}
-	go io.Copy(conn, req.Body)
+	go func() {
+		io.Copy(conn, req.Body)
+		if c, ok := conn.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+	}()
 	resp := &http.Response{
-		StatusCode: 200,
-		Body:       conn,
+		StatusCode:    200,
+		Header:        make(http.Header),
+		ContentLength: -1,
+		Body:          conn,
 	}
 	return resp, nil
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// logTo sends the log to buf, in format, until the
+// returned func is called.
+func logTo(buf *bytes.Buffer, format string) func() {
+	logFormat = format
+	log.SetOutput(buf)
+	flags := log.Flags()
+	log.SetFlags(0)
+	return func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+		logFormat = ""
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var buf bytes.Buffer
+	defer logTo(&buf, "logfmt")() // after the servers close
+	inner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Got-Host", r.Host)
+		w.Header().Set("Got-Xff", r.Header.Get("X-Forwarded-For"))
+		w.Header().Set("Got-Forwarded", r.Header.Get("Forwarded"))
+		w.Header().Set("Got-Trailer", r.Trailer.Get("X-Sum"))
+		io.WriteString(w, "hello")
+	}))
+	defer inner.Close()
+	u, _ := url.Parse(inner.URL)
+	ts := httptest.NewServer(LogHandler{newProxy(u)})
+	defer ts.Close()
+
+	req, _ := http.NewRequest("POST", ts.URL+"/a", ioutil.NopCloser(strings.NewReader("body")))
+	req.Host = "foo.webxapp.io"
+	req.Header.Set("Id", "req1")
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("Forwarded", "for=1.2.3.4;proto=https")
+	req.Trailer = http.Header{"X-Sum": {"abc"}}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("body = %q want hello", body)
+	}
+	want := map[string]string{
+		"Got-Host":      "foo.webxapp.io",
+		"Got-Xff":       "1.2.3.4", // as the router set it
+		"Got-Forwarded": "for=1.2.3.4;proto=https",
+		"Got-Trailer":   "abc",
+	}
+	for k, v := range want {
+		if g := resp.Header.Get(k); g != v {
+			t.Errorf("%s = %q want %q", k, g, v)
+		}
+	}
+	ts.Close() // wait for the log line
+	line := buf.String()
+	for _, s := range []string{"id=req1", "method=POST", "host=foo.webxapp.io", "path=/a", "status=200", "bytes=5"} {
+		if !strings.Contains(line, s) {
+			t.Errorf("log line %q missing %s", line, s)
+		}
+	}
+}
+
+func TestProxyError(t *testing.T) {
+	var buf bytes.Buffer
+	defer logTo(&buf, "json")() // after the server closes
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	l.Close() // nothing listening: the app is down
+	ts := httptest.NewServer(LogHandler{newProxy(u)})
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err, buf.String())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d want 502", resp.StatusCode)
+	}
+	ts.Close()
+	line := buf.String()
+	if !strings.Contains(line, `"status":502`) || !strings.Contains(line, `"error":"`) {
+		t.Errorf("log line %q want status 502 and an error", line)
+	}
+}
+
+func TestLogOff(t *testing.T) {
+	var buf bytes.Buffer
+	defer logTo(&buf, "off")()
+	r := httptest.NewRequest("GET", "/", nil)
+	logRequest(r, &LogResponseWriter{code: 200}, 0, "")
+	if buf.Len() != 0 {
+		t.Errorf("logged %q with WEBX_LOG=off", buf.String())
+	}
+}
+
+func TestWebsocketRefused(t *testing.T) {
+	inner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			t.Errorf("app got Upgrade %q", r.Header.Get("Upgrade"))
+		}
+		http.Error(w, "nope", http.StatusForbidden)
+	}))
+	defer inner.Close()
+	u, _ := url.Parse(inner.URL)
+
+	const upgrade = "GET /chat HTTP/1.1\r\nHost: foo.webxapp.io\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	r, _ := http.NewRequest("WEBSOCKET", "http://foo.webxapp.io/", strings.NewReader(upgrade))
+	w := httptest.NewRecorder()
+	newProxy(u).ServeHTTP(w, r)
+
+	// The router reads the app's own response out of the
+	// body and sends it on to the client as it is.
+	resp, err := http.ReadResponse(bufio.NewReader(w.Body), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusForbidden || string(body) != "nope\n" {
+		t.Errorf("app response = %d %q want 403 %q", resp.StatusCode, body, "nope\n")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/kr/webx"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Latency buckets, in seconds.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+type gauge struct{ n int64 }
+
+func (g *gauge) Add(d int64)  { atomic.AddInt64(&g.n, d) }
+func (g *gauge) Value() int64 { return atomic.LoadInt64(&g.n) }
+
+var (
+	requestsInFlight  gauge
+	websocketSessions gauge
+
+	metricsMu   sync.Mutex
+	requests    = make(map[int]int64) // by status code
+	latency     = make([]int64, len(latencyBuckets))
+	latencySum  float64
+	latencyN    int64
+	routerConns = make(map[int]webx.ConnState) // by connection number
+)
+
+func observeRequest(r *http.Request, code int, d time.Duration) {
+	if r.Method == "WEBSOCKET" {
+		return // latency is the session length
+	}
+	sec := d.Seconds()
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	requests[code]++
+	for i, le := range latencyBuckets {
+		if sec <= le {
+			latency[i]++
+		}
+	}
+	latencySum += sec
+	latencyN++
+}
+
+// routerConnState records the state of connection number
+// conn. Several connections can go to the same router
+// address, so they're told apart by number, not address.
+func routerConnState(conn int, state webx.ConnState) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if state == webx.StateClosed {
+		delete(routerConns, conn)
+	} else {
+		routerConns[conn] = state
+	}
+}
+
+// Metrics serves the metrics in the Prometheus text format.
+// The latency here is the app's own; compare it with the
+// router's webx_backend_request_duration_seconds to see
+// how much the tunnel adds.
+func Metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	header(bw, "webxd_requests_total", "counter", "Requests served, by status code.")
+	var codes []int
+	for c := range requests {
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+	for _, c := range codes {
+		fmt.Fprintf(bw, "webxd_requests_total{code=\"%d\"} %d\n", c, requests[c])
+	}
+
+	header(bw, "webxd_request_duration_seconds", "histogram", "Time the app took to serve a request.")
+	for i, le := range latencyBuckets {
+		fmt.Fprintf(bw, "webxd_request_duration_seconds_bucket{le=\"%s\"} %d\n",
+			strconv.FormatFloat(le, 'g', -1, 64), latency[i])
+	}
+	fmt.Fprintf(bw, "webxd_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", latencyN)
+	fmt.Fprintf(bw, "webxd_request_duration_seconds_sum %s\n", strconv.FormatFloat(latencySum, 'g', -1, 64))
+	fmt.Fprintf(bw, "webxd_request_duration_seconds_count %d\n", latencyN)
+
+	header(bw, "webxd_requests_in_flight", "gauge", "Requests being served.")
+	fmt.Fprintf(bw, "webxd_requests_in_flight %d\n", requestsInFlight.Value())
+	header(bw, "webxd_websocket_sessions", "gauge", "Open websocket sessions.")
+	fmt.Fprintf(bw, "webxd_websocket_sessions %d\n", websocketSessions.Value())
+
+	header(bw, "webxd_router_connections", "gauge", "Connections to the router, by state.")
+	n := make(map[webx.ConnState]int)
+	for _, s := range routerConns {
+		n[s]++
+	}
+	for _, s := range []webx.ConnState{webx.StateDialing, webx.StateActive, webx.StateDraining} {
+		fmt.Fprintf(bw, "webxd_router_connections{state=\"%s\"} %d\n", s, n[s])
+	}
+}
+
+func header(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func listenMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", Metrics)
+	log.Println("listen metrics", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		log.Fatal("metrics: ", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/kr/webx"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouterConns(t *testing.T) {
+	defer func(m map[int]webx.ConnState) { routerConns = m }(routerConns)
+	routerConns = make(map[int]webx.ConnState)
+
+	// two connections to the same router address
+	routerConnState(0, webx.StateDialing)
+	routerConnState(1, webx.StateDialing)
+	routerConnState(0, webx.StateActive)
+	routerConnState(1, webx.StateActive)
+	routerConnState(1, webx.StateClosed)
+	routerConnState(1, webx.StateDialing)
+
+	body := scrape()
+	for _, s := range []string{
+		`webxd_router_connections{state="dialing"} 1`,
+		`webxd_router_connections{state="active"} 1`,
+		`webxd_router_connections{state="draining"} 0`,
+	} {
+		if !strings.Contains(body, s+"\n") {
+			t.Errorf("metrics missing %s", s)
+		}
+	}
+}
+
+func TestObserveRequest(t *testing.T) {
+	defer func(m map[int]int64) { requests = m }(requests)
+	requests = make(map[int]int64)
+	n := latencyN
+
+	r := httptest.NewRequest("GET", "/", nil)
+	observeRequest(r, 200, 20*time.Millisecond)
+	observeRequest(r, 503, time.Millisecond)
+	observeRequest(httptest.NewRequest("WEBSOCKET", "/", nil), 200, time.Hour)
+	if latencyN != n+2 {
+		t.Errorf("latencyN = %d want %d", latencyN, n+2)
+	}
+	body := scrape()
+	for _, s := range []string{
+		`webxd_requests_total{code="200"} 1`,
+		`webxd_requests_total{code="503"} 1`,
+	} {
+		if !strings.Contains(body, s+"\n") {
+			t.Errorf("metrics missing %s", s)
+		}
+	}
+}
+
+func scrape() string {
+	w := httptest.NewRecorder()
+	Metrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}